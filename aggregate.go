@@ -0,0 +1,302 @@
+package tdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"strconv"
+)
+
+type metricKind int
+
+const (
+	countMetric metricKind = iota
+	distinctTrailsMetric
+	sumMetric
+)
+
+/*
+Metric is a value computed for every group of an aggregation: Count,
+DistinctTrails or Sum.
+*/
+type Metric struct {
+	kind  metricKind
+	field string
+}
+
+var (
+	// Count counts the events of the group.
+	Count = Metric{kind: countMetric}
+	// DistinctTrails counts the trails with at least one event in the group.
+	DistinctTrails = Metric{kind: distinctTrailsMetric}
+)
+
+/*
+Sum adds up the values of field over the events of the group. Values
+are parsed as floats; empty values count as 0 and other values that are
+not numbers make the aggregation fail.
+*/
+func Sum(field string) Metric {
+	return Metric{kind: sumMetric, field: field}
+}
+
+// String returns the column name of the metric in an AggregateResult.
+func (m Metric) String() string {
+	switch m.kind {
+	case countMetric:
+		return "count"
+	case distinctTrailsMetric:
+		return "distinct_trails"
+	case sumMetric:
+		return "sum(" + m.field + ")"
+	}
+	return "unknown"
+}
+
+/*
+AggregateSpec describes an aggregation: the events matching Filter (all
+events if nil) are grouped by the values of the GroupBy fields, and
+every Metric is computed for every group.
+*/
+type AggregateSpec struct {
+	GroupBy []string
+	Filter  *Query
+	Metrics []Metric
+	// number of goroutines, GOMAXPROCS if <= 0, see ParallelScan
+	Workers int
+}
+
+/*
+AggregateResult is the table computed by Aggregate. Columns holds the
+GroupBy fields followed by the names of the metrics.
+*/
+type AggregateResult struct {
+	Columns []string
+	Rows    []AggregateRow
+}
+
+/*
+AggregateRow is a group of an AggregateResult: Group holds the values of
+the GroupBy fields and Values the metrics, in the order of the spec.
+*/
+type AggregateRow struct {
+	Group  []string
+	Values []float64
+}
+
+/*
+Aggregate groups the events of the DB as described by spec. Rows are
+sorted by group values. Events are grouped by item, so values are only
+materialized for the groups of the result, and trails are scanned in
+parallel.
+
+With only-diff items (see SetOnlyDiffItems) fields keep their value from
+the previous event of the trail, as in TrailState.
+*/
+func (db *TrailDB) Aggregate(spec AggregateSpec) (*AggregateResult, error) {
+	return db.AggregateContext(context.Background(), spec)
+}
+
+/*
+AggregateContext is Aggregate with a context, which stops the scan when
+done, and scan options such as WithProgress.
+*/
+func (db *TrailDB) AggregateContext(ctx context.Context, spec AggregateSpec, opts ...ScanOption) (*AggregateResult, error) {
+	groups, err := db.aggregate(ctx, spec, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	result := &AggregateResult{Columns: slices.Clone(spec.GroupBy)}
+	for _, m := range spec.Metrics {
+		result.Columns = append(result.Columns, m.String())
+	}
+	result.Rows = make([]AggregateRow, 0, len(groups))
+	for _, group := range groups {
+		result.Rows = append(result.Rows, AggregateRow{
+			Group:  db.groupValues(group.items),
+			Values: group.values,
+		})
+	}
+	slices.SortFunc(result.Rows, func(a, b AggregateRow) int {
+		return slices.Compare(a.Group, b.Group)
+	})
+	return result, nil
+}
+
+func (db *TrailDB) groupValues(items []Item) []string {
+	values := make([]string, len(items))
+	for i, item := range items {
+		values[i] = db.ItemValue(item)
+	}
+	return values
+}
+
+// aggGroup is a group of an aggregation, keyed by its bucket and items.
+type aggGroup struct {
+	bucket    int64
+	items     []Item
+	values    []float64
+	lastTrail uint64 // id + 1 of the last trail counted by DistinctTrails
+}
+
+// aggregator is the State of a worker of an aggregation.
+type aggregator struct {
+	groupBy []Field
+	metrics []Metric
+	bucket  func(timestamp uint64) int64
+	sums    []Field // field of every Sum metric, 0 for other metrics
+	groups  map[string]*aggGroup
+	numbers map[Item]float64 // parsed values of the Sum fields
+	state   *TrailState
+	key     []byte
+}
+
+/*
+aggregate runs spec over the DB and returns its groups by key. If bucket
+is not nil, the time bucket it returns for the timestamp of every event
+is part of the group key.
+*/
+func (db *TrailDB) aggregate(ctx context.Context, spec AggregateSpec, bucket func(timestamp uint64) int64, opts []ScanOption) (map[string]*aggGroup, error) {
+	groupBy := make([]Field, len(spec.GroupBy))
+	for i, name := range spec.GroupBy {
+		field, ok := db.fieldNameToId[name]
+		if !ok || field == 0 {
+			return nil, &UnknownFieldError{Field: name}
+		}
+		groupBy[i] = Field(field)
+	}
+	sums := make([]Field, len(spec.Metrics))
+	for i, m := range spec.Metrics {
+		switch m.kind {
+		case countMetric, distinctTrailsMetric:
+		case sumMetric:
+			field, ok := db.fieldNameToId[m.field]
+			if !ok || field == 0 {
+				return nil, &UnknownFieldError{Field: m.field}
+			}
+			sums[i] = Field(field)
+		default:
+			return nil, errors.New("Unknown metric")
+		}
+	}
+	// never append to the caller's options
+	opts = slices.Clone(opts)
+	if spec.Filter != nil {
+		filter, err := spec.Filter.Bind(db)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithScanFilter(filter))
+	}
+	init := WithWorkerInit(func(w *Worker) error {
+		w.State = &aggregator{
+			groupBy: groupBy,
+			metrics: spec.Metrics,
+			bucket:  bucket,
+			sums:    sums,
+			groups:  make(map[string]*aggGroup),
+			numbers: make(map[Item]float64),
+			state:   NewTrailState(db),
+		}
+		return nil
+	})
+
+	scanWorkers, err := db.ParallelScan(ctx, spec.Workers,
+		func(w *Worker, trailID uint64, t *Trail) error {
+			agg := w.State.(*aggregator)
+			agg.state.Reset()
+			var evt Event
+			for t.NextEventInto(&evt) {
+				agg.state.Update(&evt)
+				if err := agg.add(db, trailID, evt.Timestamp); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		append(opts, init)...)
+	if err != nil {
+		return nil, err
+	}
+	agg := Reduce(scanWorkers, func(acc, agg *aggregator) *aggregator {
+		acc.merge(agg)
+		return acc
+	})
+	if agg == nil {
+		return nil, nil
+	}
+	return agg.groups, nil
+}
+
+func (agg *aggregator) add(db *TrailDB, trailID uint64, timestamp uint64) error {
+	var bucket int64
+	agg.key = agg.key[:0]
+	if agg.bucket != nil {
+		bucket = agg.bucket(timestamp)
+		agg.key = binary.LittleEndian.AppendUint64(agg.key, uint64(bucket))
+	}
+	for _, field := range agg.groupBy {
+		agg.key = binary.LittleEndian.AppendUint64(agg.key, uint64(agg.state.item(field)))
+	}
+	group, ok := agg.groups[string(agg.key)]
+	if !ok {
+		group = &aggGroup{
+			bucket: bucket,
+			items:  make([]Item, len(agg.groupBy)),
+			values: make([]float64, len(agg.metrics)),
+		}
+		for i, field := range agg.groupBy {
+			group.items[i] = agg.state.item(field)
+		}
+		agg.groups[string(agg.key)] = group
+	}
+	for i, m := range agg.metrics {
+		switch m.kind {
+		case countMetric:
+			group.values[i]++
+		case distinctTrailsMetric:
+			if group.lastTrail != trailID+1 {
+				group.values[i]++
+			}
+		case sumMetric:
+			n, err := agg.number(db, agg.state.item(agg.sums[i]))
+			if err != nil {
+				return err
+			}
+			group.values[i] += n
+		}
+	}
+	group.lastTrail = trailID + 1
+	return nil
+}
+
+func (agg *aggregator) number(db *TrailDB, item Item) (float64, error) {
+	if n, ok := agg.numbers[item]; ok {
+		return n, nil
+	}
+	var n float64
+	if value := db.ItemValue(item); value != "" {
+		var err error
+		if n, err = strconv.ParseFloat(value, 64); err != nil {
+			return 0, errors.New("Value " + strconv.Quote(value) + " of field " + db.fieldNames[item.Field()] + " is not a number")
+		}
+	}
+	agg.numbers[item] = n
+	return n, nil
+}
+
+// merge adds the groups of other to agg. Workers scan distinct trails,
+// so DistinctTrails adds up too.
+func (agg *aggregator) merge(other *aggregator) {
+	for key, group := range other.groups {
+		acc, ok := agg.groups[key]
+		if !ok {
+			agg.groups[key] = group
+			continue
+		}
+		for i, v := range group.values {
+			acc.values[i] += v
+		}
+	}
+}
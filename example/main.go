@@ -56,18 +56,8 @@ func main() {
 	fmt.Println(db.Version())
 
 	var total int
-	for i := 0; i < db.NumTrails; i++ {
-		trail, err := tdb.NewTrail(db, i)
-		if err != nil {
-			panic(err.Error())
-		}
-		// fmt.Println(trail)
-		for {
-			evt := trail.NextEvent()
-			if evt == nil {
-				trail.Close()
-				break
-			}
+	for _, trail := range db.Trails() {
+		for evt := range trail.Events() {
 			total++
 			fmt.Println(evt.ToMap())
 		}
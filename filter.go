@@ -0,0 +1,120 @@
+package tdb
+
+/*
+#include <traildb.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+var errUnboundFilter = errors.New("Event filter is not bound to a DB, see EventFilter.UnmarshalJSON")
+
+/*
+Clauses reads the query back out of the filter, resolving its items to
+field and value strings. Terms whose value doesn't occur in the DB, see
+MatchNothing, are returned as they were given to NewEventFilter. If
+libtraildb fails to read the filter back, Clauses returns the query as
+given to NewEventFilter.
+*/
+func (filter *EventFilter) Clauses() [][]FilterTerm {
+	clauses, err := filter.clauses()
+	if err != nil {
+		return filter.query
+	}
+	return clauses
+}
+
+func (filter *EventFilter) clauses() ([][]FilterTerm, error) {
+	if filter.filter == nil {
+		return filter.query, nil
+	}
+	numClauses := uint64(C.tdb_event_filter_num_clauses(filter.filter))
+	clauses := make([][]FilterTerm, numClauses)
+	for i := uint64(0); i < numClauses; i++ {
+		var numTerms C.uint64_t
+		if err := C.tdb_event_filter_num_terms(filter.filter, C.uint64_t(i), &numTerms); err != 0 {
+			return nil, errors.New(errToString(err) + ": Could not read clause " + strconv.FormatUint(i, 10) + " of event filter")
+		}
+		clause := make([]FilterTerm, 0, int(numTerms))
+		for j := uint64(0); j < uint64(numTerms); j++ {
+			term, err := filter.term(i, j)
+			if err != nil {
+				return nil, err
+			}
+			clause = append(clause, term)
+		}
+		clauses[i] = clause
+	}
+	return clauses, nil
+}
+
+// term reads term j of clause i back out of the filter.
+func (filter *EventFilter) term(i, j uint64) (FilterTerm, error) {
+	db := filter.db
+	termErr := func(err C.tdb_error) error {
+		return errors.New(errToString(err) + ": Could not read term " + strconv.FormatUint(j, 10) +
+			" of clause " + strconv.FormatUint(i, 10) + " of event filter")
+	}
+	var termType C.tdb_event_filter_term_type
+	if err := C.tdb_event_filter_get_term_type(filter.filter, C.uint64_t(i), C.uint64_t(j), &termType); err != 0 {
+		return FilterTerm{}, termErr(err)
+	}
+	if termType == C.TDB_EVENT_FILTER_TIME_RANGE_TERM {
+		var start, end C.uint64_t
+		if err := C.tdb_event_filter_get_time_range(filter.filter, C.uint64_t(i), C.uint64_t(j), &start, &end); err != 0 {
+			return FilterTerm{}, termErr(err)
+		}
+		return TimeRangeTerm(uint64(start), uint64(end)), nil
+	}
+	var item C.tdb_item
+	var isNegative C.int
+	if err := C.tdb_event_filter_get_item(filter.filter, C.uint64_t(i), C.uint64_t(j), &item, &isNegative); err != 0 {
+		return FilterTerm{}, termErr(err)
+	}
+	if item == 0 && i < uint64(len(filter.query)) && j < uint64(len(filter.query[i])) {
+		return filter.query[i][j], nil
+	}
+	return FilterTerm{
+		Field:      db.fieldNames[db.itemField(item)],
+		Value:      db.itemValue(item),
+		IsNegative: isNegative != 0,
+	}, nil
+}
+
+type filterJSON struct {
+	Clauses [][]FilterTerm `json:"clauses"`
+}
+
+/*
+MarshalJSON encodes the clauses of the filter, see Clauses. It fails if
+libtraildb fails to read the filter back.
+*/
+func (filter *EventFilter) MarshalJSON() ([]byte, error) {
+	clauses, err := filter.clauses()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(filterJSON{Clauses: clauses})
+}
+
+/*
+UnmarshalJSON decodes the clauses of a filter encoded by MarshalJSON.
+Item ids are specific to a DB, so the decoded filter is not bound to any
+DB and can't be set on a DB or cursor; compile it for a DB with
+db.NewEventFilter(filter.Clauses()).
+*/
+func (filter *EventFilter) UnmarshalJSON(data []byte) error {
+	var decoded filterJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if filter.filter != nil {
+		return errors.New("Cannot unmarshal into an event filter bound to a DB")
+	}
+	filter.query = decoded.Clauses
+	return nil
+}
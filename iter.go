@@ -0,0 +1,141 @@
+package tdb
+
+import (
+	"context"
+	"iter"
+)
+
+/*
+Trails iterates over all trails of the DB in trail id order. A single
+cursor is reused for every trail, so a yielded *Trail is only valid
+until the next iteration. The cursor is closed when the loop ends,
+including on an early break.
+
+If the cursor can't be allocated the loop yields nothing; use
+NewTrailIterator to get the error.
+*/
+func (db *TrailDB) Trails() iter.Seq2[uint64, *Trail] {
+	return db.NewTrailIterator(context.Background()).All()
+}
+
+/*
+TrailsContext is Trails, stopping when ctx is done. The yielded cursor
+checks ctx as well, see Trail.SetContext. Loops that need to tell a
+cancellation from the end of the DB check ctx.Err() afterwards.
+*/
+func (db *TrailDB) TrailsContext(ctx context.Context) iter.Seq2[uint64, *Trail] {
+	return db.NewTrailIterator(ctx).All()
+}
+
+/*
+TrailIterator is TrailsContext with error reporting:
+
+	trails := db.NewTrailIterator(ctx)
+	for id, trail := range trails.All() {
+		...
+	}
+	if err := trails.Err(); err != nil {
+		...
+	}
+*/
+type TrailIterator struct {
+	db  *TrailDB
+	ctx context.Context
+	err error
+}
+
+// NewTrailIterator creates a TrailIterator. A nil ctx never stops, as context.Background().
+func (db *TrailDB) NewTrailIterator(ctx context.Context) *TrailIterator {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &TrailIterator{db: db, ctx: ctx}
+}
+
+/*
+All yields every trail with its id. A single cursor is reused for every
+trail, so a yielded *Trail is only valid until the next iteration. The
+cursor is closed when the loop ends, including on an early break. The
+loop stops early if the cursor can't be allocated or a trail can't be
+opened, see Err.
+*/
+func (it *TrailIterator) All() iter.Seq2[uint64, *Trail] {
+	return func(yield func(uint64, *Trail) bool) {
+		it.err = nil
+		trail, err := NewCursor(it.db)
+		if err != nil {
+			it.err = err
+			return
+		}
+		defer trail.Close()
+		trail.SetContext(it.ctx)
+		for i := uint64(0); i < it.db.NumTrails; i++ {
+			if err := it.ctx.Err(); err != nil {
+				it.err = err
+				return
+			}
+			if err := GetTrail(trail, i); err != nil {
+				it.err = err
+				return
+			}
+			if !yield(i, trail) {
+				return
+			}
+		}
+		// the context may be done in the middle of the last trail
+		it.err = it.ctx.Err()
+	}
+}
+
+// Err returns the error that stopped the last loop over All, if any.
+func (it *TrailIterator) Err() error {
+	return it.err
+}
+
+/*
+Events iterates over the remaining events of the trail. The trail is not
+closed when the loop ends.
+*/
+func (trail *Trail) Events() iter.Seq[*Event] {
+	return func(yield func(*Event) bool) {
+		for {
+			evt := trail.NextEvent()
+			if evt == nil || !yield(evt) {
+				return
+			}
+		}
+	}
+}
+
+/*
+EventsContext is Events with ctx set on the trail, see Trail.SetContext.
+The context stays set after the loop.
+*/
+func (trail *Trail) EventsContext(ctx context.Context) iter.Seq[*Event] {
+	return func(yield func(*Event) bool) {
+		trail.SetContext(ctx)
+		trail.Events()(yield)
+	}
+}
+
+/*
+All iterates over the merged events of all cursors, calling
+NextBatchInto as needed. The events are reused, so a yielded *Event is
+only valid until the next iteration; use Clone to keep it.
+*/
+func (mcursor *MultiCursor) All() iter.Seq[*Event] {
+	return func(yield func(*Event) bool) {
+		events := make([]Event, MULTI_CURSOR_BUFFER_SIZE)
+		for {
+			num := mcursor.NextBatchInto(events)
+			if num == 0 {
+				return
+			}
+			for i := range events[:num] {
+				if !yield(&events[i]) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package tdb
+
+/*
+#include <traildb.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"iter"
+	"strconv"
+	"sync/atomic"
+)
+
+/*
+VALUE_CACHE_MAX_BYTES caps the memory used by the value cache of a
+TrailDB, see TrailDB.EnableValueCache.
+*/
+var VALUE_CACHE_MAX_BYTES = uint64(64 << 20)
+
+// approximate memory used by a cache entry besides the value itself
+const valueCacheEntryOverhead = 48
+
+type cachedValue struct {
+	field Field
+	value string
+}
+
+type valueCache struct {
+	values map[Item]cachedValue
+	bytes  uint64
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type ValueCacheStats struct {
+	// lookups served by the cache
+	Hits uint64
+	// lookups of items of fields that are not cached
+	Misses uint64
+	// approximate memory used by the cache
+	Bytes uint64
+}
+
+/*
+LexiconSize returns the number of distinct values of field, including the
+empty value.
+*/
+func (db *TrailDB) LexiconSize(field Field) (uint64, error) {
+	size := uint64(C.tdb_lexicon_size(db.db, C.tdb_field(field)))
+	if size == 0 {
+		return 0, errors.New("Invalid field " + strconv.FormatUint(uint64(field), 10))
+	}
+	return size, nil
+}
+
+/*
+Lexicon iterates over the distinct values of field and their items, in
+value id order, starting with the empty value, so that it yields
+LexiconSize values. It yields nothing for invalid fields.
+*/
+func (db *TrailDB) Lexicon(field Field) iter.Seq2[Item, string] {
+	return func(yield func(Item, string) bool) {
+		size := uint64(C.tdb_lexicon_size(db.db, C.tdb_field(field)))
+		if size == 0 || !yield(Item(C.tdb_make_item(C.tdb_field(field), 0)), "") {
+			return
+		}
+		for val := uint64(1); val < size; val++ {
+			var vlength C.uint64_t
+			value := C.tdb_get_value(db.db, C.tdb_field(field), C.tdb_val(val), &vlength)
+			item := Item(C.tdb_make_item(C.tdb_field(field), C.tdb_val(val)))
+			if !yield(item, C.GoStringN(value, C.int(vlength))) {
+				return
+			}
+		}
+	}
+}
+
+/*
+EnableValueCache materializes the lexicons of the given fields into Go
+memory, so that Event.ToMap, Event.Get, Event.Decode and ItemValue
+resolve their values without calling into C. It is meant for
+low-cardinality fields.
+
+The cache of a DB holds at most VALUE_CACHE_MAX_BYTES. If a field
+doesn't fit, an error is returned and that field is not cached; fields
+cached before stay cached. EnableValueCache must not be called while the
+DB is in use by other goroutines.
+*/
+func (db *TrailDB) EnableValueCache(fields ...string) error {
+	if db.valueCache == nil {
+		db.valueCache = &valueCache{values: make(map[Item]cachedValue)}
+	}
+	cache := db.valueCache
+	for _, name := range fields {
+		field, err := db.FieldByName(name)
+		if err != nil {
+			return err
+		}
+		if field == 0 {
+			return errors.New("Cannot cache values of the timestamp field")
+		}
+		empty := Item(C.tdb_make_item(C.tdb_field(field), 0))
+		if _, ok := cache.values[empty]; ok {
+			continue
+		}
+		// the lexicon includes the empty value
+		values := make(map[Item]cachedValue)
+		bytes := uint64(0)
+		for item, value := range db.Lexicon(field) {
+			bytes += uint64(len(value)) + valueCacheEntryOverhead
+			if cache.bytes+bytes > VALUE_CACHE_MAX_BYTES {
+				return errors.New("Value cache limit exceeded while caching field " + name)
+			}
+			values[item] = cachedValue{field: field, value: value}
+		}
+		for item, value := range values {
+			cache.values[item] = value
+		}
+		cache.bytes += bytes
+	}
+	return nil
+}
+
+// ValueCacheStats reports the hits and misses of the value cache.
+func (db *TrailDB) ValueCacheStats() ValueCacheStats {
+	cache := db.valueCache
+	if cache == nil {
+		return ValueCacheStats{}
+	}
+	return ValueCacheStats{
+		Hits:   cache.hits.Load(),
+		Misses: cache.misses.Load(),
+		Bytes:  cache.bytes,
+	}
+}
+
+func (db *TrailDB) itemValue(item C.tdb_item) string {
+	if cache := db.valueCache; cache != nil {
+		if cached, ok := cache.values[Item(item)]; ok {
+			cache.hits.Add(1)
+			return cached.value
+		}
+		cache.misses.Add(1)
+	}
+	var vlength C.uint64_t
+	itemValue := C.tdb_get_item_value(db.db, item, &vlength)
+	return C.GoStringN(itemValue, C.int(vlength))
+}
+
+func (db *TrailDB) itemField(item C.tdb_item) Field {
+	if cache := db.valueCache; cache != nil {
+		if cached, ok := cache.values[Item(item)]; ok {
+			return cached.field
+		}
+	}
+	return Field(C.tdb_item_field(item))
+}
+
+func (db *TrailDB) itemFieldValue(item C.tdb_item) (Field, string) {
+	if cache := db.valueCache; cache != nil {
+		if cached, ok := cache.values[Item(item)]; ok {
+			cache.hits.Add(1)
+			return cached.field, cached.value
+		}
+		cache.misses.Add(1)
+	}
+	var vlength C.uint64_t
+	itemValue := C.tdb_get_item_value(db.db, item, &vlength)
+	return Field(C.tdb_item_field(item)), C.GoStringN(itemValue, C.int(vlength))
+}
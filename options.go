@@ -0,0 +1,143 @@
+package tdb
+
+/*
+#include <traildb.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"strconv"
+	"unsafe"
+)
+
+func optValue(value uint64) C.tdb_opt_value {
+	var val C.tdb_opt_value
+	*(*C.uint64_t)(unsafe.Pointer(&val[0])) = C.uint64_t(value)
+	return val
+}
+
+func optUint64(val C.tdb_opt_value) uint64 {
+	return uint64(*(*C.uint64_t)(unsafe.Pointer(&val[0])))
+}
+
+// OutputFormat is the on-disk format written by a TrailDBConstructor.
+type OutputFormat int
+
+const (
+	// a single .tdb file, the default
+	Package OutputFormat = C.TDB_OPT_CONS_OUTPUT_FORMAT_PACKAGE
+	// a directory of files
+	Directory OutputFormat = C.TDB_OPT_CONS_OUTPUT_FORMAT_DIR
+)
+
+func (format OutputFormat) String() string {
+	switch format {
+	case Package:
+		return "package"
+	case Directory:
+		return "directory"
+	}
+	return "OutputFormat(" + strconv.Itoa(int(format)) + ")"
+}
+
+/*
+ConsOption is an option of a TrailDBConstructor, see
+TrailDBConstructor.SetOptions.
+*/
+type ConsOption func(cons *TrailDBConstructor) error
+
+/*
+Option is an option of a TrailDB, see TrailDB.SetOptions.
+*/
+type Option func(db *TrailDB) error
+
+// WithOutputFormat sets the format written by Finalize.
+func WithOutputFormat(format OutputFormat) ConsOption {
+	return func(cons *TrailDBConstructor) error {
+		if format != Package && format != Directory {
+			return errors.New("Invalid output format " + format.String())
+		}
+		return cons.SetOpt(TDB_OPT_CONS_OUTPUT_FORMAT, int(format))
+	}
+}
+
+/*
+WithoutBigrams disables bigram compression, which makes Finalize faster
+at the cost of a larger DB.
+*/
+func WithoutBigrams() ConsOption {
+	return func(cons *TrailDBConstructor) error {
+		return cons.SetOpt(TDB_OPT_CONS_NO_BIGRAMS, 1)
+	}
+}
+
+/*
+WithCursorEventBufferSize sets the number of events decoded at once by
+cursors. It applies to cursors created after the option is set and must
+be positive.
+*/
+func WithCursorEventBufferSize(size uint64) Option {
+	return func(db *TrailDB) error {
+		if size == 0 {
+			return errors.New("Cursor event buffer size must be positive")
+		}
+		err := C.tdb_set_opt(db.db, C.tdb_opt_key(TDB_OPT_CURSOR_EVENT_BUFFER_SIZE), optValue(size))
+		if err != 0 {
+			return errors.New(errToString(err))
+		}
+		return nil
+	}
+}
+
+// WithOnlyDiffItems turns the only-diff-items mode on, see SetOnlyDiffItems.
+func WithOnlyDiffItems() Option {
+	return func(db *TrailDB) error {
+		return db.SetOnlyDiffItems(true)
+	}
+}
+
+/*
+SetOptions applies opts in order and stops at the first error. Options
+must be set before Finalize.
+*/
+func (cons *TrailDBConstructor) SetOptions(opts ...ConsOption) error {
+	for _, opt := range opts {
+		if err := opt(cons); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutputFormat returns the format written by Finalize.
+func (cons *TrailDBConstructor) OutputFormat() (OutputFormat, error) {
+	format, err := cons.GetOpt(TDB_OPT_CONS_OUTPUT_FORMAT)
+	return OutputFormat(format), err
+}
+
+// NoBigrams reports whether bigram compression is disabled.
+func (cons *TrailDBConstructor) NoBigrams() (bool, error) {
+	value, err := cons.GetOpt(TDB_OPT_CONS_NO_BIGRAMS)
+	return value != 0, err
+}
+
+// SetOptions applies opts in order and stops at the first error.
+func (db *TrailDB) SetOptions(opts ...Option) error {
+	for _, opt := range opts {
+		if err := opt(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CursorEventBufferSize returns the number of events decoded at once by cursors.
+func (db *TrailDB) CursorEventBufferSize() (uint64, error) {
+	var val C.tdb_opt_value
+	err := C.tdb_get_opt(db.db, C.tdb_opt_key(TDB_OPT_CURSOR_EVENT_BUFFER_SIZE), &val)
+	if err != 0 {
+		return 0, errors.New(errToString(err))
+	}
+	return optUint64(val), nil
+}
@@ -0,0 +1,644 @@
+package tdb
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+The filter query language:
+
+	query := or
+	or    := and ("OR" and)*
+	and   := not ("AND" not)*
+	not   := "NOT" not | "(" or ")" | term
+	term  := field "=" value | field "!=" value
+	       | "time" ">=" number | "time" "<" number
+	       | "time" "in" "[" number "," number ")"
+
+Keywords are case-insensitive. Field names and values are either bare
+words or double-quoted Go strings. The "time" terms compile to time
+range terms, so "time in [a, b)" is the same as "time>=a AND time<b".
+*/
+
+// timeField is the name of the timestamp in filter queries.
+const timeField = "time"
+
+// maxFilterClauses bounds the size of a query converted to CNF.
+const maxFilterClauses = 1024
+
+/*
+ParseError is an error in a filter query. Offset is the byte offset in
+the query where the error was found.
+*/
+type ParseError struct {
+	Offset int
+	Msg    string
+}
+
+func (err *ParseError) Error() string {
+	return "filter query: " + err.Msg + " at offset " + strconv.Itoa(err.Offset)
+}
+
+/*
+ParseFilter compiles a filter query such as
+"type=click AND (country=US OR country=CA) AND NOT browser=bot" into an
+EventFilter of the DB.
+*/
+func (db *TrailDB) ParseFilter(query string, opts ...FilterOption) (*EventFilter, error) {
+	cnf, err := ParseFilterQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return db.NewEventFilter(cnf, opts...)
+}
+
+/*
+Query is a filter that is independent of any DB. Items are specific to a
+DB, so a Query is compiled into an EventFilter for every DB it is used
+with; Bind caches the compiled filter per DB handle, so the same Query
+can be used across many shards.
+*/
+type Query struct {
+	clauses [][]FilterTerm
+	opts    []FilterOption
+
+	mu      sync.Mutex
+	filters map[*TrailDB]*EventFilter
+	closed  bool
+}
+
+// NewQuery creates a Query from clauses in the form taken by NewEventFilter.
+func NewQuery(clauses [][]FilterTerm, opts ...FilterOption) *Query {
+	return &Query{clauses: clauses, opts: opts, filters: make(map[*TrailDB]*EventFilter)}
+}
+
+// ParseQuery creates a Query from a filter query, see ParseFilter.
+func ParseQuery(query string, opts ...FilterOption) (*Query, error) {
+	clauses, err := ParseFilterQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return NewQuery(clauses, opts...), nil
+}
+
+/*
+Bind returns the EventFilter of the query for db, compiling it on first
+use. The filter is owned by the query: don't free it, Close the query
+instead.
+*/
+func (q *Query) Bind(db *TrailDB) (*EventFilter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, errors.New("Query is closed")
+	}
+	if filter, ok := q.filters[db]; ok {
+		return filter, nil
+	}
+	filter, err := db.NewEventFilter(q.clauses, q.opts...)
+	if err != nil {
+		return nil, err
+	}
+	q.filters[db] = filter
+	return filter, nil
+}
+
+/*
+Unbind frees the filter compiled for db, if any. Call it before closing
+a DB the query is no longer used with.
+*/
+func (q *Query) Unbind(db *TrailDB) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if filter, ok := q.filters[db]; ok {
+		FreeEventFilter(filter)
+		delete(q.filters, db)
+	}
+}
+
+/*
+Close frees the filters compiled for every DB. Filters still set on a DB
+or cursor are kept alive until they are unset, see FreeEventFilter.
+*/
+func (q *Query) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for db, filter := range q.filters {
+		FreeEventFilter(filter)
+		delete(q.filters, db)
+	}
+	q.closed = true
+}
+
+func (q *Query) Clauses() [][]FilterTerm {
+	return q.clauses
+}
+
+// String formats the query in the filter query language.
+func (q *Query) String() string {
+	return FormatFilterQuery(q.clauses)
+}
+
+func (q *Query) MarshalJSON() ([]byte, error) {
+	return json.Marshal(filterJSON{Clauses: q.clauses})
+}
+
+// UnmarshalJSON decodes a query encoded by Query.MarshalJSON or EventFilter.MarshalJSON.
+func (q *Query) UnmarshalJSON(data []byte) error {
+	var decoded filterJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.filters) > 0 {
+		return errors.New("Cannot unmarshal into a bound query")
+	}
+	q.clauses = decoded.Clauses
+	if q.filters == nil {
+		q.filters = make(map[*TrailDB]*EventFilter)
+	}
+	return nil
+}
+
+/*
+ParseFilterQuery parses a filter query into the conjunctive normal form
+accepted by NewEventFilter: a conjunction of clauses, each clause being a
+disjunction of terms.
+*/
+func ParseFilterQuery(query string) ([][]FilterTerm, error) {
+	p := &queryParser{lexer: queryLexer{input: query}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected " + p.tok.String())
+	}
+	return expr.cnf(false)
+}
+
+/*
+FormatFilterQuery formats a query in conjunctive normal form in the
+filter query language. It is the inverse of ParseFilterQuery.
+*/
+func FormatFilterQuery(cnf [][]FilterTerm) string {
+	var b strings.Builder
+	for i, clause := range cnf {
+		if i > 0 {
+			b.WriteString(" AND ")
+		}
+		paren := len(clause) > 1 && len(cnf) > 1
+		if paren {
+			b.WriteByte('(')
+		}
+		for j, term := range clause {
+			if j > 0 {
+				b.WriteString(" OR ")
+			}
+			b.WriteString(formatTerm(term))
+		}
+		if paren {
+			b.WriteByte(')')
+		}
+	}
+	return b.String()
+}
+
+func formatTerm(term FilterTerm) string {
+	if r := term.TimeRange; r != nil {
+		switch {
+		case r.Start == 0:
+			return "time<" + strconv.FormatUint(r.End, 10)
+		case r.End == math.MaxUint64:
+			return "time>=" + strconv.FormatUint(r.Start, 10)
+		default:
+			return "time in [" + strconv.FormatUint(r.Start, 10) + ", " + strconv.FormatUint(r.End, 10) + ")"
+		}
+	}
+	op := "="
+	if term.IsNegative {
+		op = "!="
+	}
+	return formatWord(term.Field) + op + formatWord(term.Value)
+}
+
+func formatWord(s string) string {
+	if s == "" || s == timeField || isKeyword(s) {
+		return strconv.Quote(s)
+	}
+	for i := 0; i < len(s); i++ {
+		if !isWordByte(s[i]) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func isKeyword(s string) bool {
+	switch strings.ToUpper(s) {
+	case "AND", "OR", "NOT", "IN":
+		return true
+	}
+	return false
+}
+
+func isWordByte(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '(', ')', '[', ']', ',', '=', '!', '<', '>', '"':
+		return false
+	}
+	return true
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokAnd
+	tokOr
+	tokNot
+	tokIn
+	tokEq
+	tokNe
+	tokGe
+	tokLt
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokComma
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int
+}
+
+func (tok token) String() string {
+	switch tok.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(tok.text)
+	}
+	return "'" + tok.text + "'"
+}
+
+type queryLexer struct {
+	input  string
+	offset int
+}
+
+func (l *queryLexer) next() (token, error) {
+	for l.offset < len(l.input) && strings.IndexByte(" \t\n\r", l.input[l.offset]) >= 0 {
+		l.offset++
+	}
+	start := l.offset
+	if start == len(l.input) {
+		return token{kind: tokEOF, offset: start}, nil
+	}
+	simple := func(kind tokenKind, n int) (token, error) {
+		l.offset += n
+		return token{kind: kind, text: l.input[start:l.offset], offset: start}, nil
+	}
+	rest := l.input[start:]
+	switch {
+	case strings.HasPrefix(rest, "!="):
+		return simple(tokNe, 2)
+	case strings.HasPrefix(rest, ">="):
+		return simple(tokGe, 2)
+	}
+	switch rest[0] {
+	case '=':
+		return simple(tokEq, 1)
+	case '<':
+		return simple(tokLt, 1)
+	case '(':
+		return simple(tokLParen, 1)
+	case ')':
+		return simple(tokRParen, 1)
+	case '[':
+		return simple(tokLBracket, 1)
+	case ',':
+		return simple(tokComma, 1)
+	case '"':
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			return token{}, &ParseError{Offset: start, Msg: "unterminated string"}
+		}
+		s, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return token{}, &ParseError{Offset: start, Msg: "invalid string " + rest[:end+1]}
+		}
+		l.offset += end + 1
+		return token{kind: tokString, text: s, offset: start}, nil
+	}
+	end := 0
+	for end < len(rest) && isWordByte(rest[end]) {
+		end++
+	}
+	if end == 0 {
+		return token{}, &ParseError{Offset: start, Msg: "unexpected character " + strconv.QuoteRune(rune(rest[0]))}
+	}
+	word := rest[:end]
+	kind := tokWord
+	switch strings.ToUpper(word) {
+	case "AND":
+		kind = tokAnd
+	case "OR":
+		kind = tokOr
+	case "NOT":
+		kind = tokNot
+	case "IN":
+		kind = tokIn
+	}
+	return simple(kind, end)
+}
+
+type queryParser struct {
+	lexer queryLexer
+	tok   token
+}
+
+func (p *queryParser) next() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *queryParser) errorf(msg string) error {
+	return &ParseError{Offset: p.tok.offset, Msg: msg}
+}
+
+func (p *queryParser) expect(kind tokenKind, what string) (token, error) {
+	tok := p.tok
+	if tok.kind != kind {
+		return tok, p.errorf("expected " + what + ", found " + tok.String())
+	}
+	return tok, p.next()
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	return p.parseList(tokOr, p.parseAnd, func(children []queryExpr) queryExpr {
+		return orExpr(children)
+	})
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	return p.parseList(tokAnd, p.parseNot, func(children []queryExpr) queryExpr {
+		return andExpr(children)
+	})
+}
+
+func (p *queryParser) parseList(op tokenKind, parse func() (queryExpr, error), join func([]queryExpr) queryExpr) (queryExpr, error) {
+	expr, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != op {
+		return expr, nil
+	}
+	children := []queryExpr{expr}
+	for p.tok.kind == op {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		expr, err := parse()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, expr)
+	}
+	return join(children), nil
+}
+
+func (p *queryParser) parseNot() (queryExpr, error) {
+	switch p.tok.kind {
+	case tokNot:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	case tokLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *queryParser) parseWord(what string) (string, error) {
+	tok := p.tok
+	if tok.kind != tokWord && tok.kind != tokString {
+		return "", p.errorf("expected " + what + ", found " + tok.String())
+	}
+	return tok.text, p.next()
+}
+
+func (p *queryParser) parseNumber() (uint64, error) {
+	tok := p.tok
+	if tok.kind != tokWord {
+		return 0, p.errorf("expected a timestamp, found " + tok.String())
+	}
+	n, err := strconv.ParseUint(tok.text, 10, 64)
+	if err != nil {
+		return 0, p.errorf("invalid timestamp " + tok.String())
+	}
+	return n, p.next()
+}
+
+func (p *queryParser) parseTerm() (queryExpr, error) {
+	fieldTok := p.tok
+	field, err := p.parseWord("a field name")
+	if err != nil {
+		return nil, err
+	}
+	if fieldTok.kind == tokWord && field == timeField {
+		return p.parseTimeTerm()
+	}
+	term := FilterTerm{Field: field}
+	switch p.tok.kind {
+	case tokEq:
+	case tokNe:
+		term.IsNegative = true
+	default:
+		return nil, p.errorf("expected '=' or '!=', found " + p.tok.String())
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if term.Value, err = p.parseWord("a value"); err != nil {
+		return nil, err
+	}
+	return termExpr{term}, nil
+}
+
+func (p *queryParser) parseTimeTerm() (queryExpr, error) {
+	r := TimeRange{Start: 0, End: math.MaxUint64}
+	op := p.tok
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var err error
+	switch op.kind {
+	case tokGe:
+		r.Start, err = p.parseNumber()
+	case tokLt:
+		r.End, err = p.parseNumber()
+	case tokIn:
+		if _, err = p.expect(tokLBracket, "'['"); err != nil {
+			return nil, err
+		}
+		if r.Start, err = p.parseNumber(); err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tokComma, "','"); err != nil {
+			return nil, err
+		}
+		if r.End, err = p.parseNumber(); err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tokRParen, "')'")
+	default:
+		return nil, &ParseError{Offset: op.offset, Msg: "expected '>=', '<' or 'in' after time, found " + op.String()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Start >= r.End {
+		return nil, &ParseError{Offset: op.offset, Msg: "empty time range"}
+	}
+	return termExpr{FilterTerm{TimeRange: &r}}, nil
+}
+
+type queryExpr interface {
+	// cnf converts the expression, or its negation, to CNF.
+	cnf(negated bool) ([][]FilterTerm, error)
+}
+
+type termExpr struct {
+	term FilterTerm
+}
+
+type andExpr []queryExpr
+
+type orExpr []queryExpr
+
+type notExpr struct {
+	expr queryExpr
+}
+
+func (e termExpr) cnf(negated bool) ([][]FilterTerm, error) {
+	term := e.term
+	if !negated {
+		return [][]FilterTerm{{term}}, nil
+	}
+	if term.TimeRange == nil {
+		term.IsNegative = !term.IsNegative
+		return [][]FilterTerm{{term}}, nil
+	}
+	// not [start, end) is [0, start) or [end, max)
+	var clause []FilterTerm
+	if term.TimeRange.Start > 0 {
+		clause = append(clause, TimeRangeTerm(0, term.TimeRange.Start))
+	}
+	if term.TimeRange.End < math.MaxUint64 {
+		clause = append(clause, TimeRangeTerm(term.TimeRange.End, math.MaxUint64))
+	}
+	if len(clause) == 0 {
+		return nil, errors.New("filter query: negated time range matches no events")
+	}
+	return [][]FilterTerm{clause}, nil
+}
+
+func (e notExpr) cnf(negated bool) ([][]FilterTerm, error) {
+	return e.expr.cnf(!negated)
+}
+
+func (e andExpr) cnf(negated bool) ([][]FilterTerm, error) {
+	if negated {
+		return disjunction(e, true)
+	}
+	return conjunction(e, false)
+}
+
+func (e orExpr) cnf(negated bool) ([][]FilterTerm, error) {
+	if negated {
+		return conjunction(e, true)
+	}
+	return disjunction(e, false)
+}
+
+func conjunction(exprs []queryExpr, negated bool) ([][]FilterTerm, error) {
+	var cnf [][]FilterTerm
+	for _, expr := range exprs {
+		clauses, err := expr.cnf(negated)
+		if err != nil {
+			return nil, err
+		}
+		cnf = append(cnf, clauses...)
+	}
+	if len(cnf) > maxFilterClauses {
+		return nil, errors.New("filter query: too many clauses in normal form")
+	}
+	return cnf, nil
+}
+
+/*
+disjunction distributes OR over the clauses of its operands, which can
+grow the query exponentially; the size is capped by maxFilterClauses.
+*/
+func disjunction(exprs []queryExpr, negated bool) ([][]FilterTerm, error) {
+	cnf := [][]FilterTerm{{}}
+	for _, expr := range exprs {
+		clauses, err := expr.cnf(negated)
+		if err != nil {
+			return nil, err
+		}
+		if len(cnf)*len(clauses) > maxFilterClauses {
+			return nil, errors.New("filter query: too many clauses in normal form")
+		}
+		product := make([][]FilterTerm, 0, len(cnf)*len(clauses))
+		for _, left := range cnf {
+			for _, right := range clauses {
+				clause := make([]FilterTerm, 0, len(left)+len(right))
+				clause = append(append(clause, left...), right...)
+				product = append(product, clause)
+			}
+		}
+		cnf = product
+	}
+	return cnf, nil
+}
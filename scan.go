@@ -0,0 +1,221 @@
+package tdb
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// number of trail ranges per worker in ParallelScan, for load balancing
+const scanRangesPerWorker = 16
+
+/*
+Worker is a goroutine of ParallelScan. Every worker has its own cursor,
+so workers never share a *Trail.
+*/
+type Worker struct {
+	// from 0 to the number of workers - 1
+	ID int
+	// per-worker state of the scan function, merged with Reduce
+	State any
+
+	trail *Trail
+}
+
+/*
+SetFilter sets the event filter of the worker's cursor. It applies from
+the next trail on, so it is typically called from WithWorkerInit.
+*/
+func (w *Worker) SetFilter(filter *EventFilter) error {
+	return w.trail.SetFilter(filter)
+}
+
+type scanConfig struct {
+	filter   *EventFilter
+	init     func(w *Worker) error
+	progress func(p Progress)
+}
+
+/*
+Progress reports how far a scan is: Trails and Events have been scanned
+so far, out of TotalTrails and TotalEvents in the DB. Events counts the
+events read by the cursors, so it stays below TotalEvents when a filter
+is set or when the scan function does not read whole trails.
+*/
+type Progress struct {
+	Trails      uint64
+	Events      uint64
+	TotalTrails uint64
+	TotalEvents uint64
+}
+
+// progress is shared by the workers of a scan.
+type progress struct {
+	mu     sync.Mutex
+	report func(p Progress)
+	trails atomic.Uint64
+	events atomic.Uint64
+}
+
+func (p *progress) add(db *TrailDB, trails, events uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report(Progress{
+		Trails:      p.trails.Add(trails),
+		Events:      p.events.Add(events),
+		TotalTrails: db.NumTrails,
+		TotalEvents: db.NumEvents,
+	})
+}
+
+// ScanOption is an option of ParallelScan and of the scans built on it.
+type ScanOption func(config *scanConfig)
+
+// WithScanFilter sets filter on the cursor of every worker.
+func WithScanFilter(filter *EventFilter) ScanOption {
+	return func(config *scanConfig) {
+		config.filter = filter
+	}
+}
+
+/*
+WithWorkerInit calls init in every worker before it scans any trail,
+e.g. to set its State or a per-worker filter.
+*/
+func WithWorkerInit(init func(w *Worker) error) ScanOption {
+	return func(config *scanConfig) {
+		config.init = init
+	}
+}
+
+/*
+WithProgress calls report every time a worker finishes a range of
+trails. Calls are serialized, and Trails and Events never decrease from
+one call to the next. report must be quick, since workers wait for it.
+*/
+func WithProgress(report func(p Progress)) ScanOption {
+	return func(config *scanConfig) {
+		config.progress = report
+	}
+}
+
+/*
+ParallelScan calls fn for every trail of the DB, from workers goroutines
+(GOMAXPROCS if workers <= 0). Trails are split into ranges that workers
+claim as they go, and each worker scans its trails in increasing id
+order with its own cursor; t is positioned at the start of trail trailID
+and is only valid during the call.
+
+The scan stops at the first error returned by fn or when ctx is done,
+and returns that error. Cursors check ctx while reading events too (see
+Trail.SetContext), so a long trail does not delay the cancellation.
+The workers are returned so that their State can be merged with Reduce.
+*/
+func (db *TrailDB) ParallelScan(ctx context.Context, workers int, fn func(w *Worker, trailID uint64, t *Trail) error, opts ...ScanOption) ([]*Worker, error) {
+	var config scanConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if uint64(workers) > db.NumTrails {
+		workers = int(max(db.NumTrails, 1))
+	}
+	rangeSize := max(db.NumTrails/uint64(workers*scanRangesPerWorker), 1)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var prog *progress
+	if config.progress != nil {
+		prog = &progress{report: config.progress}
+	}
+	var next atomic.Uint64
+	var wg sync.WaitGroup
+	scanWorkers := make([]*Worker, workers)
+	for i := range scanWorkers {
+		w := &Worker{ID: i}
+		scanWorkers[i] = w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.scanWorker(ctx, w, &config, prog, &next, rangeSize, fn); err != nil {
+				cancel(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil {
+		return scanWorkers, err
+	}
+	return scanWorkers, nil
+}
+
+func (db *TrailDB) scanWorker(ctx context.Context, w *Worker, config *scanConfig, prog *progress, next *atomic.Uint64, rangeSize uint64, fn func(w *Worker, trailID uint64, t *Trail) error) error {
+	trail, err := NewCursor(db)
+	if err != nil {
+		return err
+	}
+	defer trail.Close()
+	w.trail = trail
+	defer func() { w.trail = nil }()
+	trail.SetContext(ctx)
+
+	if config.filter != nil {
+		if err := trail.SetFilter(config.filter); err != nil {
+			return err
+		}
+	}
+	if config.init != nil {
+		if err := config.init(w); err != nil {
+			return err
+		}
+	}
+	for {
+		start := next.Add(rangeSize) - rangeSize
+		if start >= db.NumTrails {
+			return nil
+		}
+		end := min(start+rangeSize, db.NumTrails)
+		events := trail.NumEventsRead()
+		for id := start; id < end; id++ {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := GetTrail(trail, id); err != nil {
+				return err
+			}
+			if err := fn(w, id, trail); err != nil {
+				return err
+			}
+		}
+		if prog != nil {
+			prog.add(db, end-start, trail.NumEventsRead()-events)
+		}
+	}
+}
+
+/*
+Reduce merges the State of the workers of a ParallelScan, in worker
+order, starting from the first worker with a State. Workers without a
+State are skipped.
+*/
+func Reduce[S any](workers []*Worker, merge func(acc S, state S) S) S {
+	var acc S
+	first := true
+	for _, w := range workers {
+		if w.State == nil {
+			continue
+		}
+		state := w.State.(S)
+		if first {
+			acc = state
+			first = false
+		} else {
+			acc = merge(acc, state)
+		}
+	}
+	return acc
+}
@@ -0,0 +1,41 @@
+package tdb
+
+import (
+	"context"
+	"slices"
+)
+
+/*
+FindTrailIDs returns the ids, in increasing order, of the trails that
+have at least one event matching filter, or at least one event if
+filter is nil. The filter is evaluated by libtraildb, and trails are
+searched in parallel by workers goroutines (GOMAXPROCS if workers <= 0),
+see ParallelScan.
+*/
+func (db *TrailDB) FindTrailIDs(filter *EventFilter, workers int) ([]uint64, error) {
+	return db.FindTrailIDsContext(context.Background(), filter, workers)
+}
+
+/*
+FindTrailIDsContext is FindTrailIDs with a context, which stops the
+search when done, and scan options such as WithProgress.
+*/
+func (db *TrailDB) FindTrailIDsContext(ctx context.Context, filter *EventFilter, workers int, opts ...ScanOption) ([]uint64, error) {
+	scanWorkers, err := db.ParallelScan(ctx, workers,
+		func(w *Worker, trailID uint64, t *Trail) error {
+			if _, stop := t.NextTimestamp(); !stop {
+				ids, _ := w.State.([]uint64)
+				w.State = append(ids, trailID)
+			}
+			return nil
+		},
+		append(slices.Clone(opts), WithScanFilter(filter))...)
+	if err != nil {
+		return nil, err
+	}
+	ids := Reduce(scanWorkers, func(acc []uint64, ids []uint64) []uint64 {
+		return append(acc, ids...)
+	})
+	slices.Sort(ids)
+	return ids, nil
+}
@@ -0,0 +1,93 @@
+package tdb
+
+/*
+#include <traildb.h>
+*/
+import "C"
+
+/*
+TrailState rebuilds full events from the events of an only-diff-items
+cursor, see TrailDB.SetOnlyDiffItems. Call Reset when moving to a new
+trail and Update with every event of the trail; the state then holds the
+value of every field as of the last event.
+*/
+type TrailState struct {
+	db    *TrailDB
+	items []C.tdb_item
+	empty []C.tdb_item
+}
+
+func NewTrailState(db *TrailDB) *TrailState {
+	empty := make([]C.tdb_item, db.NumFields)
+	for field := range empty {
+		empty[field] = C.tdb_make_item(C.tdb_field(field), 0)
+	}
+	state := &TrailState{
+		db:    db,
+		items: make([]C.tdb_item, db.NumFields),
+		empty: empty,
+	}
+	state.Reset()
+	return state
+}
+
+// Reset sets every field to the empty value, as at the start of a trail.
+func (state *TrailState) Reset() {
+	copy(state.items, state.empty)
+}
+
+/*
+Update applies the items of evt to the state. It returns the fields
+whose value changed; fields reported by evt with an unchanged value are
+skipped, so Update works with full events too.
+*/
+func (state *TrailState) Update(evt *Event) []Field {
+	var changed []Field
+	for _, item := range evt.items {
+		field := state.db.itemField(item)
+		if state.items[field] != item {
+			state.items[field] = item
+			changed = append(changed, field)
+		}
+	}
+	return changed
+}
+
+// Items returns the current item of every field, in field order.
+func (state *TrailState) Items() []Item {
+	items := make([]Item, len(state.items)-1)
+	for i, item := range state.items[1:] {
+		items[i] = Item(item)
+	}
+	return items
+}
+
+func (state *TrailState) item(field Field) Item {
+	return Item(state.items[field])
+}
+
+// ValueByField returns the current value of field.
+func (state *TrailState) ValueByField(field Field) string {
+	return state.db.itemValue(state.items[field])
+}
+
+/*
+Value returns the current value of the named field. The boolean is false
+if the field does not exist.
+*/
+func (state *TrailState) Value(fieldName string) (string, bool) {
+	field, ok := state.db.fieldNameToId[fieldName]
+	if !ok || field == 0 {
+		return "", false
+	}
+	return state.ValueByField(Field(field)), true
+}
+
+// ToMap returns the current value of every field, as Event.ToMap does.
+func (state *TrailState) ToMap() map[string]string {
+	fields := make(map[string]string)
+	for field, item := range state.items[1:] {
+		fields[state.db.fieldNames[field+1]] = state.db.itemValue(item)
+	}
+	return fields
+}
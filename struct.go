@@ -0,0 +1,466 @@
+package tdb
+
+/*
+#include <traildb.h>
+*/
+import "C"
+
+import (
+	"encoding"
+	"errors"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+const timestampTag = "timestamp"
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+type structField struct {
+	index int
+	name  string
+}
+
+/*
+structFields collects the `tdb:"..."` tagged fields of a struct type. The
+field tagged `tdb:"timestamp"` is returned separately, its index is -1 if
+there is none.
+*/
+func structFields(t reflect.Type) (int, []structField, error) {
+	if t.Kind() != reflect.Struct {
+		return -1, nil, errors.New(t.String() + " is not a struct")
+	}
+	timestamp := -1
+	var fields []structField
+	seen := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("tdb")
+		if name == "" || name == "-" {
+			continue
+		}
+		if !field.IsExported() {
+			return -1, nil, errors.New(t.String() + "." + field.Name + ": tdb tag on unexported field")
+		}
+		if seen[name] {
+			return -1, nil, errors.New(t.String() + "." + field.Name + ": duplicate tdb tag " + name)
+		}
+		seen[name] = true
+		if name == timestampTag {
+			timestamp = i
+		} else {
+			fields = append(fields, structField{index: i, name: name})
+		}
+	}
+	return timestamp, fields, nil
+}
+
+/*
+TypedConstructor is a TrailDBConstructor whose fields are derived from
+the `tdb:"..."` tags of T, so that the same struct can be used for
+writing with AddStruct and for reading with Event.Decode.
+*/
+type TypedConstructor[T any] struct {
+	*TrailDBConstructor
+
+	timestamp int
+	fields    []structField
+}
+
+/*
+NewTrailDBConstructorFor creates a constructor whose fields are the
+tagged fields of T, in declaration order. T must have a field tagged
+`tdb:"timestamp"`.
+*/
+func NewTrailDBConstructorFor[T any](path string) (*TypedConstructor[T], error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	timestamp, fields, err := structFields(t)
+	if err != nil {
+		return nil, err
+	}
+	if timestamp < 0 {
+		return nil, errors.New(t.String() + ": no field tagged tdb:\"timestamp\"")
+	}
+	if err := checkTimestampType(t.Field(timestamp).Type); err != nil {
+		return nil, errors.New(t.String() + "." + t.Field(timestamp).Name + ": " + err.Error())
+	}
+	ofields := make([]string, len(fields))
+	for i, field := range fields {
+		if err := checkValueType(t.Field(field.index).Type); err != nil {
+			return nil, errors.New(t.String() + "." + t.Field(field.index).Name + ": " + err.Error())
+		}
+		ofields[i] = field.name
+	}
+	cons, err := NewTrailDBConstructor(path, ofields...)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedConstructor[T]{
+		TrailDBConstructor: cons,
+		timestamp:          timestamp,
+		fields:             fields,
+	}, nil
+}
+
+/*
+AddStruct adds v as an event of the trail uuid. The timestamp is taken
+from the `tdb:"timestamp"` field, the other tagged fields are formatted
+as strings.
+*/
+func (cons *TypedConstructor[T]) AddStruct(uuid UUID, v T) error {
+	rv := reflect.ValueOf(&v).Elem()
+	timestamp, err := timestampOf(rv.Field(cons.timestamp))
+	if err != nil {
+		return err
+	}
+	values := make([]string, len(cons.fields))
+	for i, field := range cons.fields {
+		values[i], err = formatValue(rv.Field(field.index))
+		if err != nil {
+			return errors.New(field.name + ": " + err.Error())
+		}
+	}
+	return cons.AddUUID(uuid, timestamp, values)
+}
+
+func checkTimestampType(t reflect.Type) error {
+	if t == timeType {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return nil
+	}
+	return errors.New("timestamp must be an integer or time.Time, not " + t.String())
+}
+
+func timestampOf(v reflect.Value) (int64, error) {
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Unix(), nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), nil
+	}
+	return 0, errors.New("timestamp must be an integer or time.Time, not " + v.Type().String())
+}
+
+func checkValueType(t reflect.Type) error {
+	if t == timeType || t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+	}
+	return errors.New("unsupported type " + t.String())
+}
+
+/*
+formatValue formats a struct field as a TrailDB value. time.Time is
+formatted as RFC 3339 with nanoseconds.
+*/
+func formatValue(v reflect.Value) (string, error) {
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+	if v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(textMarshalerType) {
+		text, err := v.Addr().Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes()), nil
+		}
+	}
+	return "", errors.New("unsupported type " + v.Type().String())
+}
+
+/*
+decodePlan maps the tagged fields of a struct type to the fields of a
+TrailDB. Plans are built once per type and DB, see TrailDB.decodePlan.
+*/
+type decodePlan struct {
+	timestamp int
+	// tdb field id -> struct field index, -1 for fields not in the struct
+	byField []int
+	err     error
+}
+
+func (db *TrailDB) decodePlan(t reflect.Type) *decodePlan {
+	if plan, ok := db.decodePlans.Load(t); ok {
+		return plan.(*decodePlan)
+	}
+	plan := db.newDecodePlan(t)
+	actual, _ := db.decodePlans.LoadOrStore(t, plan)
+	return actual.(*decodePlan)
+}
+
+func (db *TrailDB) newDecodePlan(t reflect.Type) *decodePlan {
+	timestamp, fields, err := structFields(t)
+	if err != nil {
+		return &decodePlan{err: err}
+	}
+	if timestamp >= 0 {
+		if err := checkTimestampType(t.Field(timestamp).Type); err != nil {
+			return &decodePlan{err: errors.New(t.String() + "." + t.Field(timestamp).Name + ": " + err.Error())}
+		}
+	}
+	byField := make([]int, db.NumFields)
+	for i := range byField {
+		byField[i] = -1
+	}
+	for _, field := range fields {
+		id, ok := db.fieldNameToId[field.name]
+		if !ok || id == 0 {
+			return &decodePlan{err: errors.New(t.String() + "." + t.Field(field.index).Name + ": unknown field " + field.name)}
+		}
+		if err := checkDecodeType(t.Field(field.index).Type); err != nil {
+			return &decodePlan{err: errors.New(t.String() + "." + t.Field(field.index).Name + ": " + err.Error())}
+		}
+		byField[id] = field.index
+	}
+	return &decodePlan{timestamp: timestamp, byField: byField}
+}
+
+/*
+Decode fills the struct pointed to by ptr from the event. The field
+tagged `tdb:"timestamp"` receives the timestamp, every other tagged field
+receives the value of the TrailDB field of the same name, converted to
+the type of the struct field. Struct fields whose TrailDB field is not in
+the event are left untouched.
+
+The mapping of a struct type to the fields of the DB is computed once
+and cached. Tags that don't name a field of the DB and values that can't
+be converted are reported as errors.
+*/
+func (evt *Event) Decode(ptr any) error {
+	rv := reflect.ValueOf(ptr)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("Decode needs a non-nil pointer to a struct")
+	}
+	rv = rv.Elem()
+	plan := evt.trail.db.decodePlan(rv.Type())
+	if plan.err != nil {
+		return plan.err
+	}
+	return evt.decode(plan, rv)
+}
+
+func (evt *Event) decode(plan *decodePlan, rv reflect.Value) error {
+	if plan.timestamp >= 0 {
+		setTimestamp(rv.Field(plan.timestamp), evt.Timestamp)
+	}
+	db := evt.trail.db
+	for _, item := range evt.items {
+		field := db.itemField(item)
+		index := plan.byField[field]
+		if index < 0 {
+			continue
+		}
+		value := db.itemValue(item)
+		if err := parseValue(rv.Field(index), value); err != nil {
+			return errors.New(db.fieldNames[field] + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func checkDecodeType(t reflect.Type) error {
+	if t == timeType || reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+	}
+	return errors.New("unsupported type " + t.String())
+}
+
+func setTimestamp(v reflect.Value, timestamp uint64) {
+	if v.Type() == timeType {
+		v.Set(reflect.ValueOf(time.Unix(int64(timestamp), 0).UTC()))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(timestamp))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(timestamp)
+	}
+}
+
+/*
+parseValue is the inverse of formatValue, v must be addressable. Empty
+values decode to the zero value of any type.
+*/
+func parseValue(v reflect.Value, s string) error {
+	if s == "" {
+		v.SetZero()
+		return nil
+	}
+	if v.Type() == timeType {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return errors.New("unsupported type " + v.Type().String())
+		}
+		v.SetBytes([]byte(s))
+	default:
+		return errors.New("unsupported type " + v.Type().String())
+	}
+	return nil
+}
+
+/*
+TypedCursor is a cursor that decodes events into values of type T, as
+Event.Decode would. The mapping of T to the fields of the DB is resolved
+once when the cursor is created.
+*/
+type TypedCursor[T any] struct {
+	trail *Trail
+	plan  *decodePlan
+	evt   Event
+	err   error
+}
+
+func NewTypedCursor[T any](db *TrailDB) (*TypedCursor[T], error) {
+	plan := db.decodePlan(reflect.TypeOf((*T)(nil)).Elem())
+	if plan.err != nil {
+		return nil, plan.err
+	}
+	trail, err := NewCursor(db)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedCursor[T]{trail: trail, plan: plan}, nil
+}
+
+// GetTrail resets the cursor to the start of the trail trail_id.
+func (cursor *TypedCursor[T]) GetTrail(trail_id uint64) error {
+	cursor.err = nil
+	return GetTrail(cursor.trail, trail_id)
+}
+
+/*
+Next returns the next event of the current trail. The boolean is false
+at the end of the trail or if the event could not be decoded, in which
+case Err returns the error.
+*/
+func (cursor *TypedCursor[T]) Next() (T, bool) {
+	var v T
+	if cursor.err != nil {
+		return v, false
+	}
+	if !cursor.trail.NextEventInto(&cursor.evt) {
+		return v, false
+	}
+	if err := cursor.evt.decode(cursor.plan, reflect.ValueOf(&v).Elem()); err != nil {
+		cursor.err = err
+		return v, false
+	}
+	return v, true
+}
+
+/*
+NextBatch decodes up to len(batch) events of the current trail into
+batch and returns the number of events decoded. It returns less than
+len(batch) at the end of the trail or on a decoding error.
+*/
+func (cursor *TypedCursor[T]) NextBatch(batch []T) int {
+	for i := range batch {
+		v, ok := cursor.Next()
+		if !ok {
+			return i
+		}
+		batch[i] = v
+	}
+	return len(batch)
+}
+
+// Err returns the decoding error that stopped Next or NextBatch, if any.
+func (cursor *TypedCursor[T]) Err() error {
+	return cursor.err
+}
+
+// Trail returns the underlying cursor, e.g. to set an event filter.
+func (cursor *TypedCursor[T]) Trail() *Trail {
+	return cursor.trail
+}
+
+func (cursor *TypedCursor[T]) Close() {
+	cursor.trail.Close()
+}
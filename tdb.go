@@ -8,15 +8,43 @@ package tdb
 #include <traildb.h>
 #include <stdlib.h>
 
+static uint64_t tdb_cons_add_many(tdb_cons *cons,
+                                  uint64_t num_records,
+                                  uint64_t num_fields,
+                                  const uint8_t *uuids,
+                                  const uint64_t *timestamps,
+                                  const char **values,
+                                  const uint64_t *lengths,
+                                  tdb_error *errs)
+{
+    uint64_t i, failed = 0;
+    for (i = 0; i < num_records; i++) {
+        errs[i] = tdb_cons_add(cons,
+                               &uuids[i * 16],
+                               timestamps[i],
+                               &values[i * num_fields],
+                               &lengths[i * num_fields]);
+        if (errs[i])
+            ++failed;
+    }
+    return failed;
+}
+
 */
 import "C"
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 	"strings"
 )
@@ -37,6 +65,20 @@ type TrailDB struct {
 	maxTimestamp  uint64
 	fieldNames    []string
 	fieldNameToId map[string]uint64
+
+	// reflect.Type -> *decodePlan, see Event.Decode
+	decodePlans sync.Map
+	valueCache  *valueCache
+
+	/*
+	   filtersMu guards filter and trailFilters, and serializes setting
+	   filters in libtraildb with the cursors that read them
+	*/
+	filtersMu sync.RWMutex
+	filter    *EventFilter
+	// trail id -> *EventFilter, see SetTrailFilter
+	trailFilters    sync.Map
+	numTrailFilters atomic.Int64
 }
 
 type TrailDBConstructor struct {
@@ -48,27 +90,100 @@ type TrailDBConstructor struct {
 	valuePtr     unsafe.Pointer
 }
 
+/*
+Record is a single event passed to TrailDBConstructor.AddMany.
+*/
+type Record struct {
+	UUID      UUID
+	Timestamp int64
+	Values    []string
+}
+
+/*
+RecordError is the error of a single record in a batch passed to
+TrailDBConstructor.AddMany. Index is the position of the record in the
+batch.
+*/
+type RecordError struct {
+	Index int
+	Err   error
+}
+
+/*
+BatchError lists the records of a batch that TrailDBConstructor.AddMany
+failed to add. The other records of the batch were added.
+*/
+type BatchError []RecordError
+
 type Trail struct {
 	db     *TrailDB
 	trail  *C.tdb_cursor
-	filter *C.struct_tdb_event_filter
+	filter *EventFilter
+	// the DB filter when the cursor was created, see TrailDB.SetFilter
+	dbFilter *EventFilter
+	// the per-trail filter of the current trail, see TrailDB.SetTrailFilter
+	trailFilter *EventFilter
+
+	// see SetContext
+	ctx    context.Context
+	events uint64
 }
 
 type Event struct {
 	trail     *Trail
 	Timestamp uint64
-	Fields    map[string]string
-	items     []C.tdb_item
+	// filled by ToMap on first use
+	Fields map[string]string
+	items  []C.tdb_item
 }
 
+/*
+Field is the id of a field in a TrailDB. Field 0 is the timestamp.
+*/
+type Field uint32
+
+/*
+Item encodes a (field, value) pair of a TrailDB as an integer. Items are
+only meaningful within the DB they come from; within it, equal items mean
+equal values, so they can be compared and used as map keys instead of
+strings.
+*/
+type Item uint64
+
 type FilterTerm struct {
-	IsNegative bool
-	Value      string
-	Field      string
+	IsNegative bool   `json:"negative,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Field      string `json:"field,omitempty"`
+	// if set, the term matches events in the time range instead of Field=Value
+	TimeRange *TimeRange `json:"time_range,omitempty"`
+}
+
+/*
+TimeRange matches events with Start <= timestamp < End. Time range terms
+can't be negative.
+*/
+type TimeRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
 }
 
+// TimeRangeTerm returns a FilterTerm matching the time range [start, end).
+func TimeRangeTerm(start, end uint64) FilterTerm {
+	return FilterTerm{TimeRange: &TimeRange{Start: start, End: end}}
+}
+
+/*
+EventFilter is reference counted: DBs and cursors that use a filter keep
+it alive, and FreeEventFilter only frees it once they no longer do.
+*/
 type EventFilter struct {
 	filter *C.struct_tdb_event_filter
+	db     *TrailDB
+	query  [][]FilterTerm
+
+	mu    sync.Mutex
+	refs  int
+	freed bool
 }
 
 type MultiCursor struct {
@@ -115,8 +230,16 @@ func rawCookie(cookie string) (*C.uint8_t, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(cookiebin) != 16 {
+		return nil, errors.New("Cookie in the wrong format, needs to be 32 chars: " + cookie)
+	}
 	return (*C.uint8_t)(unsafe.Pointer(&cookiebin[0])), nil
 }
+
+func rawUUID(uuid *UUID) *C.uint8_t {
+	return (*C.uint8_t)(unsafe.Pointer(&uuid[0]))
+}
+
 func (cons *TrailDBConstructor) Add(cookie string, timestamp int64, values []string) error {
 	if len(cookie) != 32 {
 		return errors.New("Cookie in the wrong format, needs to be 32 chars: " + cookie)
@@ -125,6 +248,15 @@ func (cons *TrailDBConstructor) Add(cookie string, timestamp int64, values []str
 	if err != nil {
 		return err
 	}
+	return cons.add(cookiebin, timestamp, values)
+}
+
+// AddUUID is like Add but takes a raw UUID instead of a hex string.
+func (cons *TrailDBConstructor) AddUUID(uuid UUID, timestamp int64, values []string) error {
+	return cons.add(rawUUID(&uuid), timestamp, values)
+}
+
+func (cons *TrailDBConstructor) add(cookiebin *C.uint8_t, timestamp int64, values []string) error {
 	var values_p *C.char
 
 	ptrSize := unsafe.Sizeof(values_p)
@@ -152,6 +284,156 @@ func (cons *TrailDBConstructor) Add(cookie string, timestamp int64, values []str
 	return nil
 }
 
+/*
+AddBytes is like Add but takes raw byte values. Values are copied into a
+single C buffer and passed to tdb_cons_add with explicit lengths, so they
+may contain NUL bytes and round-trip byte for byte.
+*/
+func (cons *TrailDBConstructor) AddBytes(cookie string, timestamp int64, values [][]byte) error {
+	if len(cookie) != 32 {
+		return errors.New("Cookie in the wrong format, needs to be 32 chars: " + cookie)
+	}
+	cookiebin, err := rawCookie(cookie)
+	if err != nil {
+		return err
+	}
+	var values_p *C.char
+	ptrSize := unsafe.Sizeof(values_p)
+
+	total := 0
+	for i := 0; i < len(cons.ofields) && i < len(values); i++ {
+		total += len(values[i])
+	}
+	// +1 so that malloc never sees a zero size
+	buf := C.malloc(C.size_t(total + 1))
+	if buf == nil {
+		return errors.New("out of memory - malloc failed")
+	}
+	defer C.free(buf)
+	arena := unsafe.Slice((*byte)(buf), total+1)
+
+	offset := 0
+	for i := 0; i < len(cons.ofields); i++ {
+		element := (**C.char)(unsafe.Pointer(uintptr(cons.valuePtr) + uintptr(i)*ptrSize))
+		var value []byte
+		if i < len(values) {
+			value = values[i]
+		}
+		copy(arena[offset:], value)
+		*element = (*C.char)(unsafe.Pointer(&arena[offset]))
+		cons.valueLengths[i] = C.uint64_t(len(value))
+		offset += len(value)
+	}
+	valueLengthsPtr := (*C.uint64_t)(unsafe.Pointer(&cons.valueLengths[0]))
+	err1 := C.tdb_cons_add(cons.cons, cookiebin, C.uint64_t(timestamp), (**C.char)(cons.valuePtr), valueLengthsPtr)
+	if err1 != 0 {
+		return errors.New(errToString(err1))
+	}
+	return nil
+}
+
+/*
+AddMany adds a batch of records with a single cgo call. All UUIDs,
+timestamps and values of the batch are packed into one C buffer, which
+avoids the per-event and per-value overhead of Add for bulk loads.
+
+Records that fail to be added don't stop the batch; they are reported
+in the returned BatchError by their index in batch.
+*/
+func (cons *TrailDBConstructor) AddMany(batch []Record) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	var values_p *C.char
+	ptrSize := uint64(unsafe.Sizeof(values_p))
+	numRecords := uint64(len(batch))
+	numFields := uint64(len(cons.ofields))
+
+	dataSize := uint64(0)
+	for _, record := range batch {
+		for i := 0; i < len(cons.ofields) && i < len(record.Values); i++ {
+			dataSize += uint64(len(record.Values[i]))
+		}
+	}
+
+	/*
+	   layout of the arena, 8-byte aligned parts first:
+	   values | lengths | timestamps | errs | uuids | data
+	*/
+	valuesOffset := uint64(0)
+	lengthsOffset := valuesOffset + numRecords*numFields*ptrSize
+	timestampsOffset := lengthsOffset + numRecords*numFields*C.sizeof_uint64_t
+	errsOffset := timestampsOffset + numRecords*C.sizeof_uint64_t
+	uuidsOffset := errsOffset + numRecords*C.sizeof_tdb_error
+	dataOffset := uuidsOffset + numRecords*16
+	arenaSize := dataOffset + dataSize
+
+	ptr := C.malloc(C.size_t(arenaSize))
+	if ptr == nil {
+		return errors.New("out of memory - malloc failed")
+	}
+	defer C.free(ptr)
+	arena := unsafe.Slice((*byte)(ptr), arenaSize)
+
+	values := unsafe.Slice((**C.char)(unsafe.Pointer(&arena[valuesOffset])), numRecords*numFields)
+	lengths := unsafe.Slice((*C.uint64_t)(unsafe.Pointer(&arena[lengthsOffset])), numRecords*numFields)
+	timestamps := unsafe.Slice((*C.uint64_t)(unsafe.Pointer(&arena[timestampsOffset])), numRecords)
+	errs := unsafe.Slice((*C.tdb_error)(unsafe.Pointer(&arena[errsOffset])), numRecords)
+	uuids := arena[uuidsOffset:dataOffset]
+	data := arena[dataOffset:]
+
+	offset := 0
+	for i, record := range batch {
+		copy(uuids[i*16:], record.UUID[:])
+		timestamps[i] = C.uint64_t(record.Timestamp)
+		for j := 0; j < len(cons.ofields); j++ {
+			var value string
+			if j < len(record.Values) {
+				value = record.Values[j]
+			}
+			k := uint64(i)*numFields + uint64(j)
+			copy(data[offset:], value)
+			// point empty values at the arena start, they are never read
+			values[k] = (*C.char)(ptr)
+			if len(value) > 0 {
+				values[k] = (*C.char)(unsafe.Pointer(&data[offset]))
+			}
+			lengths[k] = C.uint64_t(len(value))
+			offset += len(value)
+		}
+	}
+
+	failed := C.tdb_cons_add_many(cons.cons,
+		C.uint64_t(numRecords),
+		C.uint64_t(numFields),
+		(*C.uint8_t)(unsafe.Pointer(&uuids[0])),
+		&timestamps[0],
+		(**C.char)(ptr),
+		(*C.uint64_t)(unsafe.Pointer(&arena[lengthsOffset])),
+		&errs[0])
+	if failed == 0 {
+		return nil
+	}
+	batchErr := make(BatchError, 0, int(failed))
+	for i, err := range errs {
+		if err != 0 {
+			batchErr = append(batchErr, RecordError{Index: i, Err: errors.New(errToString(err))})
+		}
+	}
+	return batchErr
+}
+
+func (err RecordError) Error() string {
+	return "record " + strconv.Itoa(err.Index) + ": " + err.Err.Error()
+}
+
+func (err BatchError) Error() string {
+	if len(err) == 1 {
+		return err[0].Error()
+	}
+	return err[0].Error() + " (and " + strconv.Itoa(len(err)-1) + " more errors)"
+}
+
 func (cons *TrailDBConstructor) Append(db *TrailDB) error {
 	if err := C.tdb_cons_append(cons.cons, db.db); err != 0 {
 		return errors.New(errToString(err))
@@ -177,24 +459,20 @@ const (
 )
 
 func (cons *TrailDBConstructor) SetOpt(key int, value int) error {
-	value64 := uint64(value)
-	opt_value := (*C.tdb_opt_value)(unsafe.Pointer(&value64))
-
-	err := C.tdb_cons_set_opt(cons.cons, C.tdb_opt_key(key), *opt_value)
+	err := C.tdb_cons_set_opt(cons.cons, C.tdb_opt_key(key), optValue(uint64(value)))
 	if err != 0 {
 		return errors.New(errToString(err))
 	}
 	return nil
 }
 
-func (cons *TrailDBConstructor) GetOpt(key int, value int) (int, error) {
-	var opt_value *C.tdb_opt_value
-	err := C.tdb_cons_set_opt(cons.cons, C.tdb_opt_key(key), *opt_value)
+func (cons *TrailDBConstructor) GetOpt(key int) (int, error) {
+	var val C.tdb_opt_value
+	err := C.tdb_cons_get_opt(cons.cons, C.tdb_opt_key(key), &val)
 	if err != 0 {
 		return -1, errors.New(errToString(err))
 	}
-	buf := (*C.uint64_t)(unsafe.Pointer(opt_value))
-	return int(*buf), nil
+	return int(optUint64(val)), nil
 }
 
 func (cons *TrailDBConstructor) Close() {
@@ -262,16 +540,141 @@ func (db *TrailDB) GetFieldNames() []string {
 }
 
 func (db *TrailDB) SetFilter(filter *EventFilter) error {
+	if filter.filter == nil {
+		return errUnboundFilter
+	}
 	var val C.tdb_opt_value
 	ptr := (*uintptr)(unsafe.Pointer(&val[0]))
 	*ptr = (uintptr)(unsafe.Pointer(filter.filter))
+	db.filtersMu.Lock()
+	defer db.filtersMu.Unlock()
 	err := C.tdb_set_opt(db.db, C.tdb_opt_key(TDB_OPT_EVENT_FILTER), val)
 	if err != 0 {
 		return errors.New("Could not set event filter")
 	}
+	filter.retain()
+	db.filter.release()
+	db.filter = filter
+	return nil
+}
+
+/*
+SetTrailFilter sets a filter for a single trail, which takes precedence
+over the filter set with SetFilter. It applies to trails opened with
+GetTrail after the call. The DB, and cursors on the trail, keep the
+filter alive until it is replaced or cleared.
+*/
+func (db *TrailDB) SetTrailFilter(trail_id uint64, filter *EventFilter) error {
+	db.filtersMu.Lock()
+	defer db.filtersMu.Unlock()
+	return db.setTrailFilter(trail_id, filter)
+}
+
+// ClearTrailFilter removes the filter set with SetTrailFilter, if any.
+func (db *TrailDB) ClearTrailFilter(trail_id uint64) error {
+	db.filtersMu.Lock()
+	defer db.filtersMu.Unlock()
+	return db.setTrailFilter(trail_id, nil)
+}
+
+/*
+SetTrailFilters sets the filters of many trails at once. A nil filter
+clears the filter of its trail. Every entry is checked first, so that
+on error none of the filters are set.
+*/
+func (db *TrailDB) SetTrailFilters(filters map[uint64]*EventFilter) error {
+	trail_ids := make([]uint64, 0, len(filters))
+	for trail_id, filter := range filters {
+		if trail_id >= db.NumTrails {
+			return errors.New("Could not set event filter of trail " + strconv.FormatUint(trail_id, 10) + ": no such trail")
+		}
+		if filter != nil && filter.filter == nil {
+			return errUnboundFilter
+		}
+		trail_ids = append(trail_ids, trail_id)
+	}
+	slices.Sort(trail_ids)
+
+	db.filtersMu.Lock()
+	defer db.filtersMu.Unlock()
+	for _, trail_id := range trail_ids {
+		if err := db.setTrailFilter(trail_id, filters[trail_id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *TrailDB) setTrailFilter(trail_id uint64, filter *EventFilter) error {
+	var val C.tdb_opt_value
+	if filter != nil {
+		if filter.filter == nil {
+			return errUnboundFilter
+		}
+		ptr := (*uintptr)(unsafe.Pointer(&val[0]))
+		*ptr = (uintptr)(unsafe.Pointer(filter.filter))
+	}
+	err := C.tdb_set_trail_opt(db.db, C.uint64_t(trail_id), C.tdb_opt_key(TDB_OPT_EVENT_FILTER), val)
+	if err != 0 {
+		return errors.New(errToString(err) + ": Could not set event filter of trail " + strconv.FormatUint(trail_id, 10))
+	}
+	if filter != nil {
+		filter.retain()
+		if old, loaded := db.trailFilters.Swap(trail_id, filter); loaded {
+			old.(*EventFilter).release()
+		} else {
+			db.numTrailFilters.Add(1)
+		}
+	} else if old, loaded := db.trailFilters.LoadAndDelete(trail_id); loaded {
+		old.(*EventFilter).release()
+		db.numTrailFilters.Add(-1)
+	}
 	return nil
 }
 
+/*
+retainTrailFilter returns the filter of trail_id, if any, retained for
+the caller. The caller must hold filtersMu.
+*/
+func (db *TrailDB) retainTrailFilter(trail_id uint64) *EventFilter {
+	if db.numTrailFilters.Load() == 0 {
+		return nil
+	}
+	filter, ok := db.trailFilters.Load(trail_id)
+	if !ok {
+		return nil
+	}
+	filter.(*EventFilter).retain()
+	return filter.(*EventFilter)
+}
+
+/*
+SetOnlyDiffItems turns the only-diff-items mode on or off. In this mode
+events only contain the items whose value changed since the previous
+event of the trail, see TrailState to rebuild the full events. The mode
+applies to trails opened with GetTrail after the call.
+*/
+func (db *TrailDB) SetOnlyDiffItems(enabled bool) error {
+	value := uint64(0)
+	if enabled {
+		value = 1
+	}
+	err := C.tdb_set_opt(db.db, C.tdb_opt_key(TDB_OPT_ONLY_DIFF_ITEMS), optValue(value))
+	if err != 0 {
+		return errors.New(errToString(err))
+	}
+	return nil
+}
+
+// OnlyDiffItems reports whether the only-diff-items mode is on.
+func (db *TrailDB) OnlyDiffItems() bool {
+	var val C.tdb_opt_value
+	if C.tdb_get_opt(db.db, C.tdb_opt_key(TDB_OPT_ONLY_DIFF_ITEMS), &val) != 0 {
+		return false
+	}
+	return optUint64(val) != 0
+}
+
 func (db *TrailDB) GetTrailID(cookie string) (uint64, error) {
 	var trail_id C.uint64_t
 	cookiebin, err := rawCookie(cookie)
@@ -294,6 +697,30 @@ func (db *TrailDB) GetUUID(trail_id uint64) string {
 	}
 }
 
+// TrailIDOf is like GetTrailID but takes a raw UUID.
+func (db *TrailDB) TrailIDOf(uuid UUID) (uint64, error) {
+	var trail_id C.uint64_t
+	err := C.tdb_get_trail_id(db.db, rawUUID(&uuid), &trail_id)
+	if err != 0 {
+		return 0, errors.New(errToString(err) + ": Error while fetching trail_id for UUID " + uuid.String())
+	}
+	return uint64(trail_id), nil
+}
+
+/*
+UUIDOf returns the raw UUID of a trail. Unlike GetUUID it reports an
+error for trail ids that are out of range.
+*/
+func (db *TrailDB) UUIDOf(trail_id uint64) (UUID, error) {
+	var uuid UUID
+	cuuid := C.tdb_get_uuid(db.db, C.uint64_t(trail_id))
+	if cuuid == nil {
+		return uuid, errors.New("Invalid trail_id " + strconv.FormatUint(trail_id, 10))
+	}
+	copy(uuid[:], unsafe.Slice((*byte)(unsafe.Pointer(cuuid)), 16))
+	return uuid, nil
+}
+
 func (db *TrailDB) GetField(field_name string) (uint64, error) {
 	field := C.tdb_field(0)
 	err := C.tdb_get_field(db.db, C.CString(field_name), &field)
@@ -303,26 +730,84 @@ func (db *TrailDB) GetField(field_name string) (uint64, error) {
 	return uint64(field), nil
 }
 
+// FieldByName is like GetField but returns a Field.
+func (db *TrailDB) FieldByName(field_name string) (Field, error) {
+	field, ok := db.fieldNameToId[field_name]
+	if !ok {
+		return 0, errors.New("Unknown field " + field_name)
+	}
+	return Field(field), nil
+}
+
+/*
+GetItem returns the item of value in field. The boolean is false if the
+value does not occur in the field.
+*/
+func (db *TrailDB) GetItem(field Field, value string) (Item, bool) {
+	cs := C.CString(value)
+	defer C.free(unsafe.Pointer(cs))
+	item := C.tdb_get_item(db.db, C.tdb_field(field), cs, C.uint64_t(len(value)))
+	return Item(item), item != 0
+}
+
+// ItemValue returns the value of an item.
+func (db *TrailDB) ItemValue(item Item) string {
+	return db.itemValue(C.tdb_item(item))
+}
+
+// Field returns the field of an item.
+func (item Item) Field() Field {
+	return Field(C.tdb_item_field(C.tdb_item(item)))
+}
+
 func (db *TrailDB) Version() uint64 {
 	return uint64(C.tdb_version(db.db))
 }
 
 func (db *TrailDB) Close() {
 	C.tdb_close(db.db)
+	db.filtersMu.Lock()
+	defer db.filtersMu.Unlock()
+	db.filter.release()
+	db.filter = nil
+	db.trailFilters.Range(func(trail_id, filter any) bool {
+		filter.(*EventFilter).release()
+		db.trailFilters.Delete(trail_id)
+		return true
+	})
+	db.numTrailFilters.Store(0)
 }
 
 func NewCursor(db *TrailDB) (*Trail, error) {
+	/*
+	   new cursors use the DB filter, which must stay alive until the
+	   cursor is closed even if the DB moves on to another filter
+	*/
+	db.filtersMu.RLock()
+	defer db.filtersMu.RUnlock()
 	trail := C.tdb_cursor_new(db.db)
 	if trail == nil {
 		return nil, errors.New("Could not create a new cursor (out of memory?)")
 	}
-	return &Trail{db: db, trail: trail}, nil
+	db.filter.retain()
+	return &Trail{db: db, trail: trail, dbFilter: db.filter}, nil
 }
 
 func GetTrail(trail *Trail, trail_id uint64) error {
+	/*
+	   hold filtersMu until the trail is open, so that the per-trail
+	   filter libtraildb picks up is the one retained here, and it can't
+	   be replaced and freed in between
+	*/
+	db := trail.db
+	db.filtersMu.RLock()
+	filter := db.retainTrailFilter(trail_id)
 	err := C.tdb_get_trail(trail.trail, C.uint64_t(trail_id))
+	db.filtersMu.RUnlock()
+	trail.trailFilter.release()
+	trail.trailFilter = filter
 	if err != 0 {
-		return errors.New(errToString(err) + ": Failed to open Trail with id " + string(trail_id))
+		return errors.New(errToString(err) + ": Failed to open Trail with id " + strconv.FormatUint(trail_id, 10))
 	}
 	return nil
 }
@@ -337,6 +822,9 @@ func NewTrail(db *TrailDB, trail_id uint64) (*Trail, error) {
 }
 
 func (trail *Trail) SetFilter(filter *EventFilter) error {
+	if filter.filter == nil {
+		return errUnboundFilter
+	}
 	err := C.tdb_cursor_set_event_filter(trail.trail, filter.filter)
 	if err != 0 {
 		return errors.New(errToString(err))
@@ -344,90 +832,123 @@ func (trail *Trail) SetFilter(filter *EventFilter) error {
 	/*
 	   we need to keep the filter alive for the lifetime of the cursor
 	*/
-	trail.filter = filter.filter
+	filter.retain()
+	trail.filter.release()
+	trail.filter = filter
 	return nil
 }
 
 func (trail *Trail) UnsetFilter() {
 	C.tdb_cursor_unset_event_filter(trail.trail)
+	trail.filter.release()
 	trail.filter = nil
 }
 
 func (trail *Trail) Close() {
 	C.tdb_cursor_free(trail.trail)
+	trail.filter.release()
+	trail.filter = nil
+	trail.dbFilter.release()
+	trail.dbFilter = nil
+	trail.trailFilter.release()
+	trail.trailFilter = nil
 }
 
-func (db *TrailDB) FindTrails(filters map[string]string) ([]*Trail, error) {
-	var items []C.tdb_item
-
-	for k, v := range filters {
-		cs := C.CString(v)
-		defer C.free(unsafe.Pointer(cs))
-
-		item := C.tdb_get_item(db.db, C.tdb_field(db.fieldNameToId[k]), cs, C.uint64_t(len(v)))
-		items = append(items, item)
-	}
+/*
+FindTrails returns a cursor on every trail that has an event with all of
+the given field values, see FindTrailIDs. The cursors must be closed by
+the caller.
 
-	var result []*Trail
-	for i := uint64(0); i < db.NumTrails; i++ {
-		trail, err := NewTrail(db, i)
+Deprecated: use FindTrailIDs, which returns trail ids instead of open
+cursors and supports any EventFilter.
+*/
+func (db *TrailDB) FindTrails(filters map[string]string) ([]*Trail, error) {
+	// an empty filter matches no event, so no filters means no filter
+	var filter *EventFilter
+	if len(filters) > 0 {
+		var query [][]FilterTerm
+		for k, v := range filters {
+			query = append(query, []FilterTerm{{Field: k, Value: v}})
+		}
+		var err error
+		filter, err = db.NewEventFilter(query)
 		if err != nil {
 			return nil, err
 		}
-		for {
-			evt := trail.NextEvent()
-			if evt == nil {
-				trail.Close()
-				break
-			}
-			if evt.contains(items) {
-				returnTrail, err := NewTrail(db, i)
-				if err != nil {
-					return nil, err
-				}
-				result = append(result, returnTrail)
+		defer FreeEventFilter(filter)
+	}
+	ids, err := db.FindTrailIDs(filter, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Trail, 0, len(ids))
+	for _, id := range ids {
+		trail, err := NewTrail(db, id)
+		if err != nil {
+			for _, trail := range result {
 				trail.Close()
-				break
 			}
+			return nil, err
 		}
+		result = append(result, trail)
 	}
 	return result, nil
 }
-func (evt *Event) contains(filters []C.tdb_item) bool {
-	results := make([]bool, len(filters))
-	for _, item := range evt.items {
-		for i, filter := range filters {
-			if filter == item {
-				results[i] = true
-			}
-		}
-		a := true
-		for _, r := range results {
-			a = a && r
-		}
-		if a == true {
-			return true
-		}
+
+/*
+CONTEXT_CHECK_INTERVAL is the number of events between two checks of the
+context of a cursor, see Trail.SetContext. Values <= 1 check it before
+every event.
+*/
+var CONTEXT_CHECK_INTERVAL = uint64(1000)
+
+/*
+SetContext makes the cursor check ctx every CONTEXT_CHECK_INTERVAL
+events; once ctx is done, the cursor behaves as if the trail had ended.
+Callers that need to tell both cases apart check ctx.Err(). A nil ctx
+turns the checks off.
+*/
+func (trail *Trail) SetContext(ctx context.Context) {
+	trail.ctx = ctx
+}
+
+// NumEventsRead returns the number of events read by the cursor since it was created.
+func (trail *Trail) NumEventsRead() uint64 {
+	return trail.events
+}
+
+func (trail *Trail) next() *C.tdb_event {
+	if trail.ctx != nil && (CONTEXT_CHECK_INTERVAL <= 1 || trail.events%CONTEXT_CHECK_INTERVAL == 0) && trail.ctx.Err() != nil {
+		return nil
+	}
+	event := C.tdb_cursor_next(trail.trail)
+	if event != nil {
+		trail.events++
 	}
-	return false
+	return event
 }
 
 func (trail *Trail) NextTimestamp() (uint64, bool) {
-	event := C.tdb_cursor_next(trail.trail)
+	event := trail.next()
 	if event == nil {
 		return 0, true
 	}
 	return uint64(event.timestamp), false
 }
 
+/*
+eventItems returns the items of event without copying them, the slice
+points to the cursor's buffer.
+*/
+func eventItems(event *C.tdb_event) []C.tdb_item {
+	s := (*C.tdb_item)(unsafe.Add(unsafe.Pointer(event), C.sizeof_tdb_event))
+	return unsafe.Slice(s, int(event.num_items))
+}
+
 func makeEvent(event *C.tdb_event, trail *Trail) *Event {
 	items := make([]C.tdb_item, int(event.num_items))
-
-	s := unsafe.Pointer(uintptr(unsafe.Pointer(event)) + C.sizeof_tdb_event)
-	for i := uint64(0); i < uint64(event.num_items); i++ {
-		item := *(*C.tdb_item)(unsafe.Pointer(uintptr(s) + uintptr(i*C.sizeof_tdb_item)))
-		items[i] = item
-	}
+	copy(items, eventItems(event))
 
 	return &Event{
 		trail:     trail,
@@ -437,7 +958,7 @@ func makeEvent(event *C.tdb_event, trail *Trail) *Event {
 }
 
 func (trail *Trail) NextEvent() *Event {
-	event := C.tdb_cursor_next(trail.trail)
+	event := trail.next()
 	if event == nil {
 		return nil
 	} else {
@@ -445,6 +966,46 @@ func (trail *Trail) NextEvent() *Event {
 	}
 }
 
+/*
+NextEventInto reads the next event of the trail into evt without
+allocating. It returns false at the end of the trail.
+
+evt becomes a view: its items are read straight from the cursor's C
+buffer, so evt is only valid until the next call to NextEvent,
+NextEventInto or GetTrail on this trail, or until the trail is closed.
+Use Clone to keep the event longer.
+*/
+func (trail *Trail) NextEventInto(evt *Event) bool {
+	event := trail.next()
+	if event == nil {
+		return false
+	}
+	evt.setView(event, trail)
+	return true
+}
+
+func (evt *Event) setView(event *C.tdb_event, trail *Trail) {
+	evt.trail = trail
+	evt.Timestamp = uint64(event.timestamp)
+	evt.Fields = nil
+	evt.items = eventItems(event)
+}
+
+/*
+Clone returns a copy of the event that owns its items, so that it stays
+valid after the cursor moves on.
+*/
+func (evt *Event) Clone() *Event {
+	items := make([]C.tdb_item, len(evt.items))
+	copy(items, evt.items)
+	return &Event{
+		trail:     evt.trail,
+		Timestamp: evt.Timestamp,
+		Fields:    maps.Clone(evt.Fields),
+		items:     items,
+	}
+}
+
 func (trail *Trail) GetTrailLength() int {
     tlength := C.tdb_get_trail_length(trail.trail)
     return int(tlength)
@@ -454,26 +1015,115 @@ func (evt *Event) Print() {
 	fmt.Printf("%d: %s\n", evt.Timestamp, evt.ToMap())
 }
 
+/*
+Get returns the value of the index-th item of the event. Items are
+numbered from 0 and don't include the timestamp, so index is the field id
+minus one, and only as long as every field is present in the event. Use
+Value or ValueByField to look values up by field.
+*/
 func (evt *Event) Get(index int) string {
+	return evt.trail.db.itemValue(evt.items[index])
+}
+
+/*
+Value returns the value of the named field in this event. The boolean is
+false if the field does not exist or is not present in the event, which
+happens with only-diff-items cursors.
+*/
+func (evt *Event) Value(fieldName string) (string, bool) {
+	field, ok := evt.trail.db.fieldNameToId[fieldName]
+	if !ok {
+		return "", false
+	}
+	return evt.ValueByField(Field(field))
+}
+
+/*
+ValueByField is like Value but takes a field id. Field 0 returns the
+timestamp in decimal.
+*/
+func (evt *Event) ValueByField(field Field) (string, bool) {
+	if field == 0 {
+		return strconv.FormatUint(evt.Timestamp, 10), true
+	}
+	db := evt.trail.db
+	for _, item := range evt.items {
+		if db.itemField(item) == field {
+			return db.itemValue(item), true
+		}
+	}
+	return "", false
+}
+
+/*
+GetBytes is like Get but returns the raw value bytes without converting
+them to a Go string.
+*/
+func (evt *Event) GetBytes(index int) []byte {
 	var vlength C.uint64_t
 	itemValue := C.tdb_get_item_value(evt.trail.db.db, evt.items[index], &vlength)
-	value := C.GoStringN(itemValue, C.int(vlength))
-	return value
+	return C.GoBytes(unsafe.Pointer(itemValue), C.int(vlength))
+}
+
+/*
+ValueBytes returns the raw bytes of the named field in this event. The
+boolean is false if the field does not exist or is not present in the
+event.
+*/
+func (evt *Event) ValueBytes(fieldName string) ([]byte, bool) {
+	field, ok := evt.trail.db.fieldNameToId[fieldName]
+	if !ok || field == 0 {
+		return nil, false
+	}
+	for _, item := range evt.items {
+		if uint64(evt.trail.db.itemField(item)) == field {
+			var vlength C.uint64_t
+			itemValue := C.tdb_get_item_value(evt.trail.db.db, item, &vlength)
+			return C.GoBytes(unsafe.Pointer(itemValue), C.int(vlength)), true
+		}
+	}
+	return nil, false
 }
 
+/*
+Items returns the items of the event without copying them. The slice
+must not be modified and, for events filled by NextEventInto, is only
+valid as long as the event.
+*/
+func (evt *Event) Items() []Item {
+	if len(evt.items) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*Item)(unsafe.Pointer(&evt.items[0])), len(evt.items))
+}
+
+/*
+ToMap returns the fields of the event as a map from field name to value.
+The map is stored in evt.Fields and returned as is by later calls.
+*/
 func (evt *Event) ToMap() map[string]string {
+	if evt.Fields != nil {
+		return evt.Fields
+	}
 	fields := make(map[string]string)
-	var vlength C.uint64_t
+	db := evt.trail.db
 
 	for _, item := range evt.items {
-		itemValue := C.tdb_get_item_value(evt.trail.db.db, item, &vlength)
-		value := C.GoStringN(itemValue, C.int(vlength))
-		key := C.GoString(C.tdb_get_field_name(evt.trail.db.db, C.tdb_item_field(item)))
-		fields[key] = value
+		field, value := db.itemFieldValue(item)
+		fields[db.fieldNames[field]] = value
 	}
+	evt.Fields = fields
 	return fields
 }
 
+/*
+ToStruct returns a reflect.Value holding a pointer to a new struct of the
+type of data, filled from the `tdb:"..."` tagged fields of the event.
+
+Deprecated: ToStruct assumes the first struct field is the timestamp,
+only supports string fields and breaks with only-diff-items cursors. Use
+Decode instead.
+*/
 func (evt *Event) ToStruct(data interface{}) interface{} {
 	t := reflect.TypeOf(data)
 
@@ -501,41 +1151,167 @@ func (evt *Event) ToStruct(data interface{}) interface{} {
 	return v
 }
 
-func (db *TrailDB) NewEventFilter(query [][]FilterTerm) *EventFilter {
-	filter := EventFilter{filter: C.tdb_event_filter_new()}
+/*
+UnknownFieldError is returned by NewEventFilter for terms on fields that
+don't exist in the DB.
+*/
+type UnknownFieldError struct {
+	Field string
+}
+
+func (err *UnknownFieldError) Error() string {
+	return "Unknown field " + err.Field
+}
+
+/*
+UnknownValueError is returned by NewEventFilter for terms on values that
+don't occur in their field, if the MissingValueError policy is used.
+*/
+type UnknownValueError struct {
+	Field string
+	Value string
+}
+
+func (err *UnknownValueError) Error() string {
+	return "Unknown value " + strconv.Quote(err.Value) + " of field " + err.Field
+}
+
+/*
+MissingValuePolicy tells NewEventFilter what to do with terms on values
+that don't occur in their field.
+*/
+type MissingValuePolicy int
+
+const (
+	// the term matches no event, or every event if negative. The default.
+	MatchNothing MissingValuePolicy = iota
+	// NewEventFilter returns an UnknownValueError
+	MissingValueError
+	// the term matches events whose value of the field is empty
+	MatchEmpty
+)
+
+type filterConfig struct {
+	missingValues MissingValuePolicy
+}
+
+// FilterOption is an option of NewEventFilter and ParseFilter.
+type FilterOption func(config *filterConfig)
+
+// WithMissingValues sets the policy for values missing from the DB.
+func WithMissingValues(policy MissingValuePolicy) FilterOption {
+	return func(config *filterConfig) {
+		config.missingValues = policy
+	}
+}
+
+/*
+NewEventFilter compiles a query in conjunctive normal form into an
+EventFilter: every clause must match, and a clause matches if any of its
+terms does. Terms on unknown fields return an UnknownFieldError.
+*/
+func (db *TrailDB) NewEventFilter(query [][]FilterTerm, opts ...FilterOption) (*EventFilter, error) {
+	var config filterConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	filter := &EventFilter{filter: C.tdb_event_filter_new(), db: db, query: query}
+	if filter.filter == nil {
+		return nil, errors.New("Could not create a new event filter (out of memory?)")
+	}
+	if err := db.addFilterTerms(filter, query, &config); err != nil {
+		C.tdb_event_filter_free(filter.filter)
+		return nil, err
+	}
+	return filter, nil
+}
+
+func (db *TrailDB) addFilterTerms(filter *EventFilter, query [][]FilterTerm, config *filterConfig) error {
 	for i, clause := range query {
 		if i > 0 {
 			err := C.tdb_event_filter_new_clause(filter.filter)
 			if err != 0 {
-				return nil
+				return errors.New(errToString(err))
 			}
 		}
 		for _, term := range clause {
-			item := C.tdb_item(0)
-			field_id, err := db.GetField(term.Field)
-			if err == nil {
-				cs := C.CString(term.Value)
-				defer C.free(unsafe.Pointer(cs))
-				item = C.tdb_get_item(db.db,
-					C.tdb_field(field_id),
-					cs,
-					C.uint64_t(len(term.Value)))
+			if term.TimeRange != nil {
+				if term.IsNegative {
+					return errors.New("Time range terms can't be negative")
+				}
+				ret := C.tdb_event_filter_add_time_range(filter.filter,
+					C.uint64_t(term.TimeRange.Start),
+					C.uint64_t(term.TimeRange.End))
+				if ret != 0 {
+					return errors.New(errToString(ret))
+				}
+				continue
+			}
+			field_id, ok := db.fieldNameToId[term.Field]
+			if !ok || field_id == 0 {
+				return &UnknownFieldError{Field: term.Field}
+			}
+			item, found := db.GetItem(Field(field_id), term.Value)
+			if !found {
+				switch config.missingValues {
+				case MissingValueError:
+					return &UnknownValueError{Field: term.Field, Value: term.Value}
+				case MatchEmpty:
+					item = Item(C.tdb_make_item(C.tdb_field(field_id), 0))
+				}
 			}
 			isNegative := C.int(0)
 			if term.IsNegative {
 				isNegative = 1
 			}
-			ret := C.tdb_event_filter_add_term(filter.filter, item, isNegative)
+			ret := C.tdb_event_filter_add_term(filter.filter, C.tdb_item(item), isNegative)
 			if ret != 0 {
-				return nil
+				return errors.New(errToString(ret))
 			}
 		}
 	}
-	return &filter
+	return nil
+}
+
+// String formats the filter in the filter query language, see ParseFilter.
+func (filter *EventFilter) String() string {
+	return FormatFilterQuery(filter.Clauses())
 }
 
+/*
+FreeEventFilter frees the filter once no DB or cursor uses it anymore.
+*/
 func FreeEventFilter(filter *EventFilter) {
-	C.tdb_event_filter_free(filter.filter)
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	if filter.freed {
+		return
+	}
+	filter.freed = true
+	if filter.refs == 0 && filter.filter != nil {
+		C.tdb_event_filter_free(filter.filter)
+	}
+}
+
+func (filter *EventFilter) retain() {
+	if filter == nil {
+		return
+	}
+	filter.mu.Lock()
+	filter.refs++
+	filter.mu.Unlock()
+}
+
+func (filter *EventFilter) release() {
+	if filter == nil {
+		return
+	}
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	filter.refs--
+	if filter.refs == 0 && filter.freed {
+		C.tdb_event_filter_free(filter.filter)
+	}
 }
 
 func NewMultiCursor(cursors []*Trail) (*MultiCursor, error) {
@@ -588,3 +1364,22 @@ func (mcursor *MultiCursor) NextBatch() []*Event {
 
 	return mcursor.event_buffer[:num]
 }
+
+/*
+NextBatchInto is NextBatch without allocations: it fills events with
+views of the next merged events, as NextEventInto does, and returns
+their number, at most MULTI_CURSOR_BUFFER_SIZE. The events are only
+valid until the next call to NextBatch, NextBatchInto or Reset.
+*/
+func (mcursor *MultiCursor) NextBatchInto(events []Event) int {
+	size := min(len(events), MULTI_CURSOR_BUFFER_SIZE)
+	cnum := C.tdb_multi_cursor_next_batch(mcursor.mcursor,
+		(*C.tdb_multi_event)(mcursor.mevent_buffer_ptr),
+		C.uint64_t(size))
+	num := int(cnum)
+	mevents := unsafe.Slice((*C.tdb_multi_event)(mcursor.mevent_buffer_ptr), num)
+	for i, mevent := range mevents {
+		events[i].setView(mevent.event, mcursor.cursors[mevent.cursor_idx])
+	}
+	return num
+}
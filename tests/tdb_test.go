@@ -1,12 +1,18 @@
 package tests
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/traildb/traildb-go"
 )
@@ -166,7 +172,8 @@ func TestFiltersDisjunction(t *testing.T) {
 
 	term1 := tdb.FilterTerm{Field: "field1", Value: "a"}
 	term2 := tdb.FilterTerm{Field: "field2", Value: "3"}
-	filter := db.NewEventFilter([][]tdb.FilterTerm{{term1, term2}})
+	filter, err := db.NewEventFilter([][]tdb.FilterTerm{{term1, term2}})
+	ok(t, err)
 
 	trail := ApplyFilter(t, filter, db)
 	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "f", "field2": "3"}, 3)
@@ -180,7 +187,8 @@ func TestFiltersConjunction(t *testing.T) {
 
 	term1 := tdb.FilterTerm{Field: "field1", Value: "e"}
 	term2 := tdb.FilterTerm{Field: "field2", Value: "2"}
-	filter := db.NewEventFilter([][]tdb.FilterTerm{{term1}, {term2}})
+	filter, err := db.NewEventFilter([][]tdb.FilterTerm{{term1}, {term2}})
+	ok(t, err)
 	trail := ApplyFilter(t, filter, db)
 
 	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "e", "field2": "2"}, 2)
@@ -193,7 +201,8 @@ func TestFiltersNegation(t *testing.T) {
 
 	term1 := tdb.FilterTerm{Field: "field1", Value: "e", IsNegative: true}
 	term2 := tdb.FilterTerm{Field: "field2", Value: "4", IsNegative: true}
-	filter := db.NewEventFilter([][]tdb.FilterTerm{{term1}, {term2}})
+	filter, err := db.NewEventFilter([][]tdb.FilterTerm{{term1}, {term2}})
+	ok(t, err)
 
 	trail := ApplyFilter(t, filter, db)
 	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "d", "field2": "1"}, 1)
@@ -220,3 +229,1092 @@ func TestMultiCursors(t *testing.T) {
 	AssertEvent(t, batch[4], map[string]string{"field1": "f", "field2": "3"}, 3)
 	AssertEvent(t, batch[5], map[string]string{"field1": "c", "field2": "3"}, 3)
 }
+
+func TestAddBytes(t *testing.T) {
+	cons, err := tdb.NewTrailDBConstructor(DbName, "field1", "field2")
+	ok(t, err)
+	raw := []byte{0x00, 0xff, 'a', 0x00, 'b'}
+	ok(t, cons.AddBytes(UUID1, 1, [][]byte{raw, []byte("x")}))
+	ok(t, cons.AddBytes(UUID1, 2, [][]byte{[]byte("y")}))
+	ok(t, cons.Finalize())
+	cons.Close()
+
+	db := ReadDB(t)
+	defer DeleteDB(t)
+
+	trail := GetTrailAt(0, t, db)
+	evt := trail.NextEvent()
+	assert(t, evt != nil, "Could not get event")
+	equals(t, raw, evt.GetBytes(0))
+	value, found := evt.ValueBytes("field2")
+	assert(t, found, "field2 should be present")
+	equals(t, []byte("x"), value)
+
+	evt = trail.NextEvent()
+	assert(t, evt != nil, "Could not get event")
+	value, found = evt.ValueBytes("field2")
+	assert(t, found, "field2 should be present")
+	equals(t, []byte{}, value)
+	_, found = evt.ValueBytes("field3")
+	assert(t, !found, "field3 should not be present")
+}
+
+func TestUUID(t *testing.T) {
+	uuid, err := tdb.ParseUUID(UUID1)
+	ok(t, err)
+	equals(t, UUID1, uuid.String())
+	equals(t, "12345678-1234-5678-1234-567812345678", uuid.Dashed())
+
+	dashed, err := tdb.ParseUUID(uuid.Dashed())
+	ok(t, err)
+	equals(t, uuid, dashed)
+
+	_, err = tdb.ParseUUID("1234")
+	assert(t, err != nil, "should fail on short UUID")
+	_, err = tdb.ParseUUID("12345678x1234-5678-1234-567812345678")
+	assert(t, err != nil, "should fail on misplaced dashes")
+
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	id, err := db.TrailIDOf(uuid)
+	ok(t, err)
+	equals(t, uint64(1), id)
+
+	got, err := db.UUIDOf(1)
+	ok(t, err)
+	equals(t, uuid, got)
+
+	_, err = db.UUIDOf(db.NumTrails)
+	assert(t, err != nil, "should fail on invalid trail id")
+
+	_, err = db.GetTrailID("1234")
+	assert(t, err != nil, "should fail on short cookie")
+}
+
+func TestAddMany(t *testing.T) {
+	uuid1, err := tdb.ParseUUID(UUID1)
+	ok(t, err)
+	uuid2, err := tdb.ParseUUID(UUID2)
+	ok(t, err)
+
+	cons, err := tdb.NewTrailDBConstructor(DbName, "field1", "field2")
+	ok(t, err)
+	ok(t, cons.AddMany([]tdb.Record{
+		{UUID: uuid1, Timestamp: 1, Values: []string{"a", "1"}},
+		{UUID: uuid1, Timestamp: 2, Values: []string{"b"}},
+		{UUID: uuid2, Timestamp: 1, Values: []string{"", "2"}},
+	}))
+	ok(t, cons.Finalize())
+	cons.Close()
+
+	db := ReadDB(t)
+	defer DeleteDB(t)
+
+	equals(t, uint64(2), db.NumTrails)
+	equals(t, uint64(3), db.NumEvents)
+
+	trail := GetTrailAt(1, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "1"}, 1)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "b", "field2": ""}, 2)
+	AssertNotEvent(t, trail.NextEvent())
+
+	trail = GetTrailAt(0, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "", "field2": "2"}, 1)
+	AssertNotEvent(t, trail.NextEvent())
+}
+
+func TestAddManyErrors(t *testing.T) {
+	uuid1, err := tdb.ParseUUID(UUID1)
+	ok(t, err)
+	uuid2, err := tdb.ParseUUID(UUID2)
+	ok(t, err)
+
+	cons, err := tdb.NewTrailDBConstructor(DbName, "field1", "field2")
+	ok(t, err)
+	err = cons.AddMany([]tdb.Record{
+		{UUID: uuid1, Timestamp: 1, Values: []string{"a", "1"}},
+		{UUID: uuid1, Timestamp: math.MaxInt64, Values: []string{"b", "2"}},
+		{UUID: uuid2, Timestamp: 3, Values: []string{"c", "3"}},
+	})
+	var batchErr tdb.BatchError
+	assert(t, errors.As(err, &batchErr), "expected a BatchError, got %v", err)
+	equals(t, 1, len(batchErr))
+	equals(t, 1, batchErr[0].Index)
+	ok(t, cons.Finalize())
+	cons.Close()
+
+	// the other records of the batch were added
+	db := ReadDB(t)
+	defer DeleteDB(t)
+
+	equals(t, uint64(2), db.NumEvents)
+	trail := GetTrailAt(1, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "1"}, 1)
+	AssertNotEvent(t, trail.NextEvent())
+	trail = GetTrailAt(0, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "c", "field2": "3"}, 3)
+	AssertNotEvent(t, trail.NextEvent())
+}
+
+type Level int
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("level-%d", int(l))), nil
+}
+
+type WriteEvent struct {
+	Timestamp int64   `tdb:"timestamp"`
+	Name      string  `tdb:"name"`
+	Count     int     `tdb:"count"`
+	Price     float64 `tdb:"price"`
+	Active    bool    `tdb:"active"`
+	Level     Level   `tdb:"level"`
+	Ignored   string
+}
+
+func TestAddStruct(t *testing.T) {
+	uuid, err := tdb.ParseUUID(UUID1)
+	ok(t, err)
+
+	cons, err := tdb.NewTrailDBConstructorFor[WriteEvent](DbName)
+	ok(t, err)
+	ok(t, cons.AddStruct(uuid, WriteEvent{Timestamp: 5, Name: "x", Count: -3, Price: 1.5, Active: true, Level: 2, Ignored: "y"}))
+	ok(t, cons.Finalize())
+	cons.Close()
+
+	db := ReadDB(t)
+	defer DeleteDB(t)
+
+	equals(t, []string{"name", "count", "price", "active", "level"}, db.GetFieldNames())
+	trail := GetTrailAt(0, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{
+		"name": "x", "count": "-3", "price": "1.5", "active": "true", "level": "level-2"}, 5)
+
+	_, err = tdb.NewTrailDBConstructorFor[struct {
+		Name string `tdb:"name"`
+	}](DbName)
+	assert(t, err != nil, "should fail without a timestamp field")
+}
+
+type ReadEvent struct {
+	Time   time.Time `tdb:"timestamp"`
+	Name   string    `tdb:"name"`
+	Count  int16     `tdb:"count"`
+	Price  float32   `tdb:"price"`
+	Active bool      `tdb:"active"`
+	Level  LevelText `tdb:"level"`
+}
+
+type LevelText struct {
+	Text string
+}
+
+func (l *LevelText) UnmarshalText(text []byte) error {
+	l.Text = "parsed-" + string(text)
+	return nil
+}
+
+func TestDecode(t *testing.T) {
+	uuid, err := tdb.ParseUUID(UUID1)
+	ok(t, err)
+
+	cons, err := tdb.NewTrailDBConstructorFor[WriteEvent](DbName)
+	ok(t, err)
+	ok(t, cons.AddStruct(uuid, WriteEvent{Timestamp: 5, Name: "x", Count: -3, Price: 1.5, Active: true, Level: 2}))
+	ok(t, cons.Add(UUID1, 6, []string{"y", "not a number"}))
+	ok(t, cons.Finalize())
+	cons.Close()
+
+	db := ReadDB(t)
+	defer DeleteDB(t)
+
+	trail := GetTrailAt(0, t, db)
+	var evt ReadEvent
+	ok(t, trail.NextEvent().Decode(&evt))
+	equals(t, ReadEvent{
+		Time: time.Unix(5, 0).UTC(), Name: "x", Count: -3, Price: 1.5, Active: true,
+		Level: LevelText{"parsed-level-2"}}, evt)
+
+	var write WriteEvent
+	next := trail.NextEvent()
+	assert(t, next.Decode(&write) != nil, "should fail to parse count")
+	assert(t, next.Decode(write) != nil, "should fail on non-pointer")
+
+	var unknown struct {
+		Missing string `tdb:"missing"`
+	}
+	assert(t, next.Decode(&unknown) != nil, "should fail on unknown field")
+}
+
+type Ev struct {
+	Timestamp uint64 `tdb:"timestamp"`
+	Field1    string `tdb:"field1"`
+	Field2    int    `tdb:"field2"`
+}
+
+func TestTypedCursor(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	cursor, err := tdb.NewTypedCursor[Ev](db)
+	ok(t, err)
+	defer cursor.Close()
+
+	ok(t, cursor.GetTrail(1))
+	evt, found := cursor.Next()
+	assert(t, found, "Could not get event")
+	equals(t, Ev{1, "a", 1}, evt)
+
+	batch := make([]Ev, 5)
+	equals(t, 2, cursor.NextBatch(batch))
+	equals(t, []Ev{{2, "b", 2}, {3, "c", 3}}, batch[:2])
+	_, found = cursor.Next()
+	assert(t, !found, "Not expected event")
+	ok(t, cursor.Err())
+
+	ok(t, cursor.GetTrail(0))
+	equals(t, 4, cursor.NextBatch(batch))
+	equals(t, Ev{4, "a", 4}, batch[3])
+
+	_, err = tdb.NewTypedCursor[struct {
+		Field3 string `tdb:"field3"`
+	}](db)
+	assert(t, err != nil, "should fail on unknown field")
+}
+
+func TestIterators(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	lengths := make(map[uint64]int)
+	for id, trail := range db.Trails() {
+		for range trail.Events() {
+			lengths[id]++
+		}
+	}
+	equals(t, map[uint64]int{0: 4, 1: 3}, lengths)
+
+	it := db.NewTrailIterator(context.Background())
+	for range it.All() {
+	}
+	ok(t, it.Err())
+
+	for id := range db.Trails() {
+		equals(t, uint64(0), id)
+		break
+	}
+
+	trail := GetTrailAt(0, t, db)
+	for evt := range trail.Events() {
+		AssertEvent(t, evt, map[string]string{"field1": "d", "field2": "1"}, 1)
+		break
+	}
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "e", "field2": "2"}, 2)
+
+	trails, err := db.FindTrails(map[string]string{"field1": "a"})
+	ok(t, err)
+	multiCursor, err := tdb.NewMultiCursor(trails)
+	ok(t, err)
+	defer tdb.FreeMultiCursor(multiCursor)
+	var timestamps []uint64
+	for evt := range multiCursor.All() {
+		timestamps = append(timestamps, evt.Timestamp)
+	}
+	equals(t, []uint64{1, 1, 2, 2, 3, 3, 4}, timestamps)
+}
+
+func TestNextEventInto(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	trail := GetTrailAt(1, t, db)
+	var evt tdb.Event
+	assert(t, trail.NextEventInto(&evt), "Could not get event")
+	AssertEvent(t, &evt, map[string]string{"field1": "a", "field2": "1"}, 1)
+	clone := evt.Clone()
+
+	assert(t, trail.NextEventInto(&evt), "Could not get event")
+	AssertEvent(t, &evt, map[string]string{"field1": "b", "field2": "2"}, 2)
+	assert(t, trail.NextEventInto(&evt), "Could not get event")
+	assert(t, !trail.NextEventInto(&evt), "Not expected event")
+
+	ok(t, tdb.GetTrail(trail, 0))
+	assert(t, trail.NextEventInto(&evt), "Could not get event")
+	AssertEvent(t, clone, map[string]string{"field1": "a", "field2": "1"}, 1)
+
+	// a clone has its own fields
+	fields := clone.ToMap()
+	other := clone.Clone()
+	fields["field1"] = "z"
+	equals(t, "a", other.ToMap()["field1"])
+
+	allocs := testing.AllocsPerRun(100, func() {
+		ok(t, tdb.GetTrail(trail, 0))
+		for trail.NextEventInto(&evt) {
+		}
+	})
+	equals(t, 0.0, allocs)
+
+	trails, err := db.FindTrails(map[string]string{"field1": "a"})
+	ok(t, err)
+	multiCursor, err := tdb.NewMultiCursor(trails)
+	ok(t, err)
+	defer tdb.FreeMultiCursor(multiCursor)
+	events := make([]tdb.Event, 10)
+	num := multiCursor.NextBatchInto(events)
+	assert(t, num > 1, "Could not get events")
+	AssertEvent(t, &events[0], map[string]string{"field1": "d", "field2": "1"}, 1)
+	AssertEvent(t, &events[1], map[string]string{"field1": "a", "field2": "1"}, 1)
+	for num > 0 {
+		num = multiCursor.NextBatchInto(events)
+	}
+
+	allocs = testing.AllocsPerRun(100, func() {
+		for id, trail := range trails {
+			ok(t, tdb.GetTrail(trail, uint64(id)))
+		}
+		multiCursor.Reset()
+		for multiCursor.NextBatchInto(events) > 0 {
+		}
+	})
+	equals(t, 0.0, allocs)
+}
+
+func TestItems(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	field1, err := db.FieldByName("field1")
+	ok(t, err)
+	equals(t, tdb.Field(1), field1)
+	_, err = db.FieldByName("field3")
+	assert(t, err != nil, "should fail if invalid field")
+
+	itemA, found := db.GetItem(field1, "a")
+	assert(t, found, "item should exist")
+	equals(t, field1, itemA.Field())
+	equals(t, "a", db.ItemValue(itemA))
+	_, found = db.GetItem(field1, "z")
+	assert(t, !found, "item should not exist")
+
+	trail := GetTrailAt(1, t, db)
+	items := trail.NextEvent().Items()
+	equals(t, 2, len(items))
+	equals(t, itemA, items[0])
+	equals(t, "1", db.ItemValue(items[1]))
+	last := GetTrailAt(0, t, db)
+	for evt := range last.Events() {
+		if evt.Timestamp == 4 {
+			equals(t, itemA, evt.Items()[0])
+		}
+	}
+}
+
+func TestLexicon(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	field1, err := db.FieldByName("field1")
+	ok(t, err)
+	size, err := db.LexiconSize(field1)
+	ok(t, err)
+	equals(t, uint64(7), size)
+	_, err = db.LexiconSize(tdb.Field(3))
+	assert(t, err != nil, "should fail if invalid field")
+
+	values := make(map[string]bool)
+	for item, value := range db.Lexicon(field1) {
+		equals(t, field1, item.Field())
+		equals(t, value, db.ItemValue(item))
+		values[value] = true
+	}
+	equals(t, map[string]bool{"": true, "a": true, "b": true, "c": true, "d": true, "e": true, "f": true}, values)
+	equals(t, int(size), len(values))
+	for range db.Lexicon(tdb.Field(3)) {
+		t.Fatal("Not expected value of an invalid field")
+	}
+}
+
+func TestValueCache(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	equals(t, tdb.ValueCacheStats{}, db.ValueCacheStats())
+	ok(t, db.EnableValueCache("field1"))
+	assert(t, db.EnableValueCache("field3") != nil, "should fail if invalid field")
+
+	trail := GetTrailAt(1, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "1"}, 1)
+	evt := trail.NextEvent()
+	equals(t, "b", evt.Get(0))
+	equals(t, "2", evt.Get(1))
+
+	stats := db.ValueCacheStats()
+	equals(t, uint64(2), stats.Hits)
+	equals(t, uint64(2), stats.Misses)
+	assert(t, stats.Bytes > 0, "cache should use memory")
+
+	limit := tdb.VALUE_CACHE_MAX_BYTES
+	tdb.VALUE_CACHE_MAX_BYTES = stats.Bytes
+	assert(t, db.EnableValueCache("field2") != nil, "should fail over the memory cap")
+	tdb.VALUE_CACHE_MAX_BYTES = limit
+}
+
+func TestEventValue(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	trail := GetTrailAt(1, t, db)
+	evt := trail.NextEvent()
+	value, found := evt.Value("field2")
+	assert(t, found, "field2 should be present")
+	equals(t, "1", value)
+	_, found = evt.Value("field3")
+	assert(t, !found, "field3 should not be present")
+
+	field1, err := db.FieldByName("field1")
+	ok(t, err)
+	value, found = evt.ValueByField(field1)
+	assert(t, found, "field1 should be present")
+	equals(t, "a", value)
+	value, found = evt.ValueByField(0)
+	assert(t, found, "timestamp should be present")
+	equals(t, "1", value)
+
+	assert(t, evt.Fields == nil, "Fields should be filled lazily")
+	fields := evt.ToMap()
+	equals(t, fields, evt.Fields)
+}
+
+func TestOnlyDiffItems(t *testing.T) {
+	cons, err := tdb.NewTrailDBConstructor(DbName, "field1", "field2")
+	ok(t, err)
+	ok(t, cons.Add(UUID1, 1, []string{"a", "1"}))
+	ok(t, cons.Add(UUID1, 2, []string{"a", "2"}))
+	ok(t, cons.Add(UUID1, 3, []string{"b", "2"}))
+	ok(t, cons.Finalize())
+	cons.Close()
+
+	db := ReadDB(t)
+	defer DeleteDB(t)
+
+	assert(t, !db.OnlyDiffItems(), "only-diff-items should be off by default")
+	ok(t, db.SetOnlyDiffItems(true))
+	assert(t, db.OnlyDiffItems(), "only-diff-items should be on")
+
+	trail := GetTrailAt(0, t, db)
+	state := tdb.NewTrailState(db)
+
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "1"}, 1)
+
+	evt := trail.NextEvent()
+	AssertEvent(t, evt, map[string]string{"field2": "2"}, 2)
+	state.Update(evt)
+	equals(t, map[string]string{"field1": "", "field2": "2"}, state.ToMap())
+
+	state.Reset()
+	ok(t, tdb.GetTrail(trail, 0))
+	var changed [][]tdb.Field
+	for evt := range trail.Events() {
+		changed = append(changed, state.Update(evt))
+	}
+	equals(t, [][]tdb.Field{{1, 2}, {2}, {1}}, changed)
+	equals(t, map[string]string{"field1": "b", "field2": "2"}, state.ToMap())
+	value, found := state.Value("field1")
+	assert(t, found, "field1 should exist")
+	equals(t, "b", value)
+
+	ok(t, db.SetOnlyDiffItems(false))
+	trail = GetTrailAt(0, t, db)
+	trail.NextEvent()
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "2"}, 2)
+}
+
+func TestOptions(t *testing.T) {
+	cons, err := tdb.NewTrailDBConstructor(DbName, "field1", "field2")
+	ok(t, err)
+	format, err := cons.OutputFormat()
+	ok(t, err)
+	equals(t, tdb.Package, format)
+	noBigrams, err := cons.NoBigrams()
+	ok(t, err)
+	assert(t, !noBigrams, "bigrams should be on by default")
+
+	ok(t, cons.SetOptions(tdb.WithOutputFormat(tdb.Directory), tdb.WithoutBigrams()))
+	format, err = cons.OutputFormat()
+	ok(t, err)
+	equals(t, tdb.Directory, format)
+	noBigrams, err = cons.NoBigrams()
+	ok(t, err)
+	assert(t, noBigrams, "bigrams should be off")
+	assert(t, cons.SetOptions(tdb.WithOutputFormat(tdb.OutputFormat(42))) != nil, "should fail on invalid format")
+
+	ok(t, cons.SetOptions(tdb.WithOutputFormat(tdb.Package)))
+	ok(t, cons.Add(UUID1, 1, []string{"a", "1"}))
+	ok(t, cons.Finalize())
+	cons.Close()
+
+	db := ReadDB(t)
+	defer DeleteDB(t)
+
+	ok(t, db.SetOptions(tdb.WithCursorEventBufferSize(10), tdb.WithOnlyDiffItems()))
+	size, err := db.CursorEventBufferSize()
+	ok(t, err)
+	equals(t, uint64(10), size)
+	assert(t, db.OnlyDiffItems(), "only-diff-items should be on")
+	assert(t, db.SetOptions(tdb.WithCursorEventBufferSize(0)) != nil, "should fail on empty buffer")
+}
+
+func TestTrailFilters(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	onlyA, err := db.NewEventFilter([][]tdb.FilterTerm{{{Field: "field1", Value: "a"}}})
+	ok(t, err)
+	notA, err := db.NewEventFilter([][]tdb.FilterTerm{{{Field: "field1", Value: "a", IsNegative: true}}})
+	ok(t, err)
+	ok(t, db.SetTrailFilter(0, onlyA))
+	// the DB keeps the filter alive
+	tdb.FreeEventFilter(onlyA)
+
+	trail := GetTrailAt(0, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "4"}, 4)
+	AssertNotEvent(t, trail.NextEvent())
+
+	trail = GetTrailAt(1, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "1"}, 1)
+
+	ok(t, db.SetTrailFilters(map[uint64]*tdb.EventFilter{0: nil, 1: notA}))
+	trail = GetTrailAt(0, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "d", "field2": "1"}, 1)
+	trail = GetTrailAt(1, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "b", "field2": "2"}, 2)
+
+	// nothing is set if an entry is invalid
+	trail.Close()
+	err = db.SetTrailFilters(map[uint64]*tdb.EventFilter{0: notA, 2: notA})
+	assert(t, err != nil, "should fail on a trail id out of range")
+	trail = GetTrailAt(0, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "d", "field2": "1"}, 1)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "e", "field2": "2"}, 2)
+	trail.Close()
+	unbound := &tdb.EventFilter{}
+	err = db.SetTrailFilters(map[uint64]*tdb.EventFilter{0: notA, 1: unbound})
+	assert(t, err != nil, "should fail on an unbound filter")
+	trail = GetTrailAt(0, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "d", "field2": "1"}, 1)
+	trail.Close()
+
+	trail = GetTrailAt(1, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "b", "field2": "2"}, 2)
+	ok(t, db.ClearTrailFilter(1))
+	// the cursor still uses notA
+	tdb.FreeEventFilter(notA)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "c", "field2": "3"}, 3)
+	trail.Close()
+
+	trail = GetTrailAt(1, t, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "1"}, 1)
+	trail.Close()
+
+	// cursors keep the DB filter they were created with alive
+	dbA, err := db.NewEventFilter([][]tdb.FilterTerm{{{Field: "field1", Value: "a"}}})
+	ok(t, err)
+	ok(t, db.SetFilter(dbA))
+	trail, err = tdb.NewTrail(db, 0)
+	ok(t, err)
+	dbNotA, err := db.NewEventFilter([][]tdb.FilterTerm{{{Field: "field1", Value: "a", IsNegative: true}}})
+	ok(t, err)
+	ok(t, db.SetFilter(dbNotA))
+	tdb.FreeEventFilter(dbA)
+	tdb.FreeEventFilter(dbNotA)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "4"}, 4)
+	trail.Close()
+}
+
+func TestFiltersTimeRange(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	term1 := tdb.FilterTerm{Field: "field1", Value: "e"}
+	term2 := tdb.FilterTerm{Field: "field1", Value: "a"}
+	filter, err := db.NewEventFilter([][]tdb.FilterTerm{{term1, term2}, {tdb.TimeRangeTerm(2, 4)}})
+	ok(t, err)
+	trail := ApplyFilter(t, filter, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "e", "field2": "2"}, 2)
+	AssertNotEvent(t, trail.NextEvent())
+
+	filter, err = db.NewEventFilter([][]tdb.FilterTerm{{tdb.TimeRangeTerm(3, 10), term1}})
+	ok(t, err)
+	trail = ApplyFilter(t, filter, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "e", "field2": "2"}, 2)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "f", "field2": "3"}, 3)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "4"}, 4)
+	AssertNotEvent(t, trail.NextEvent())
+
+	negative := tdb.TimeRangeTerm(1, 2)
+	negative.IsNegative = true
+	_, err = db.NewEventFilter([][]tdb.FilterTerm{{negative}})
+	assert(t, err != nil, "should fail on negative time range")
+}
+
+func TestParseFilterQuery(t *testing.T) {
+	cnf, err := tdb.ParseFilterQuery("type=click AND (country=US OR country=CA) AND NOT browser=bot")
+	ok(t, err)
+	equals(t, [][]tdb.FilterTerm{
+		{{Field: "type", Value: "click"}},
+		{{Field: "country", Value: "US"}, {Field: "country", Value: "CA"}},
+		{{Field: "browser", Value: "bot", IsNegative: true}},
+	}, cnf)
+	equals(t, "type=click AND (country=US OR country=CA) AND browser!=bot", tdb.FormatFilterQuery(cnf))
+
+	cnf, err = tdb.ParseFilterQuery("a=1 OR (b=2 and not (c=3 or d!=4))")
+	ok(t, err)
+	equals(t, [][]tdb.FilterTerm{
+		{{Field: "a", Value: "1"}, {Field: "b", Value: "2"}},
+		{{Field: "a", Value: "1"}, {Field: "c", Value: "3", IsNegative: true}},
+		{{Field: "a", Value: "1"}, {Field: "d", Value: "4"}},
+	}, cnf)
+
+	cnf, err = tdb.ParseFilterQuery(`name="a \"b\"" AND "and"="" AND time in [2, 4) AND NOT time<10`)
+	ok(t, err)
+	equals(t, [][]tdb.FilterTerm{
+		{{Field: "name", Value: `a "b"`}},
+		{{Field: "and", Value: ""}},
+		{tdb.TimeRangeTerm(2, 4)},
+		{tdb.TimeRangeTerm(10, math.MaxUint64)},
+	}, cnf)
+	query := tdb.FormatFilterQuery(cnf)
+	equals(t, `name="a \"b\"" AND "and"="" AND time in [2, 4) AND time>=10`, query)
+	again, err := tdb.ParseFilterQuery(query)
+	ok(t, err)
+	equals(t, cnf, again)
+
+	for query, offset := range map[string]int{
+		"a=1 AND":       7,
+		"a=1 b=2":       4,
+		"(a=1":          4,
+		"a 1":           2,
+		`a="1`:          2,
+		"time>=x":       6,
+		"time in [3,2)": 5,
+	} {
+		_, err := tdb.ParseFilterQuery(query)
+		perr, isParseError := err.(*tdb.ParseError)
+		assert(t, isParseError, "expected a parse error for %q, got %v", query, err)
+		equals(t, offset, perr.Offset)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	filter, err := db.ParseFilter("(field1=a OR field2=3) AND NOT time<4")
+	ok(t, err)
+	equals(t, "(field1=a OR field2=3) AND time>=4", filter.String())
+	trail := ApplyFilter(t, filter, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "4"}, 4)
+	AssertNotEvent(t, trail.NextEvent())
+}
+
+func TestFiltersErrors(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	_, err := db.NewEventFilter([][]tdb.FilterTerm{{{Field: "field3", Value: "a"}}})
+	unknownField, isUnknownField := err.(*tdb.UnknownFieldError)
+	assert(t, isUnknownField, "expected an unknown field error, got %v", err)
+	equals(t, "field3", unknownField.Field)
+
+	missing := [][]tdb.FilterTerm{{{Field: "field1", Value: "z"}}}
+	_, err = db.NewEventFilter(missing, tdb.WithMissingValues(tdb.MissingValueError))
+	unknownValue, isUnknownValue := err.(*tdb.UnknownValueError)
+	assert(t, isUnknownValue, "expected an unknown value error, got %v", err)
+	equals(t, tdb.UnknownValueError{Field: "field1", Value: "z"}, *unknownValue)
+
+	filter, err := db.NewEventFilter(missing)
+	ok(t, err)
+	trail := ApplyFilter(t, filter, db)
+	AssertNotEvent(t, trail.NextEvent())
+
+	filter, err = db.ParseFilter("field1!=z")
+	ok(t, err)
+	trail = ApplyFilter(t, filter, db)
+	equals(t, 4, len(slices.Collect(trail.Events())))
+
+	_, err = db.ParseFilter("field1=z", tdb.WithMissingValues(tdb.MissingValueError))
+	assert(t, err != nil, "should fail on unknown value")
+}
+
+func TestFiltersMatchEmpty(t *testing.T) {
+	cons, err := tdb.NewTrailDBConstructor(DbName, "field1", "field2")
+	ok(t, err)
+	ok(t, cons.Add(UUID1, 1, []string{"a", "1"}))
+	ok(t, cons.Add(UUID1, 2, []string{"", "2"}))
+	ok(t, cons.Finalize())
+	cons.Close()
+
+	db := ReadDB(t)
+	defer DeleteDB(t)
+
+	filter, err := db.ParseFilter("field1=z", tdb.WithMissingValues(tdb.MatchEmpty))
+	ok(t, err)
+	trail := ApplyFilter(t, filter, db)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "", "field2": "2"}, 2)
+	AssertNotEvent(t, trail.NextEvent())
+}
+
+func TestFilterClauses(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	query := [][]tdb.FilterTerm{
+		{{Field: "field1", Value: "a"}, {Field: "field2", Value: "3", IsNegative: true}},
+		{tdb.TimeRangeTerm(2, 5)},
+		{{Field: "field1", Value: "missing"}, {Field: "field2", Value: "4"}},
+	}
+	filter, err := db.NewEventFilter(query)
+	ok(t, err)
+	equals(t, query, filter.Clauses())
+
+	data, err := json.Marshal(filter)
+	ok(t, err)
+	equals(t, `{"clauses":[[{"value":"a","field":"field1"},{"negative":true,"value":"3","field":"field2"}],`+
+		`[{"time_range":{"start":2,"end":5}}],[{"value":"missing","field":"field1"},{"value":"4","field":"field2"}]]}`,
+		string(data))
+
+	var decoded tdb.EventFilter
+	ok(t, json.Unmarshal(data, &decoded))
+	equals(t, query, decoded.Clauses())
+	equals(t, filter.String(), decoded.String())
+	trail := GetTrailAt(0, t, db)
+	assert(t, trail.SetFilter(&decoded) != nil, "should fail on unbound filter")
+
+	rebuilt, err := db.NewEventFilter(decoded.Clauses())
+	ok(t, err)
+	ok(t, trail.SetFilter(rebuilt))
+	ok(t, tdb.GetTrail(trail, 0))
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "4"}, 4)
+	AssertNotEvent(t, trail.NextEvent())
+}
+
+func TestQuery(t *testing.T) {
+	query, err := tdb.ParseQuery("field1=a OR field1=e")
+	ok(t, err)
+	equals(t, "field1=a OR field1=e", query.String())
+
+	db1 := LoadDB(t)
+	db2 := ReadDB(t)
+	defer DeleteDB(t)
+
+	filter1, err := query.Bind(db1)
+	ok(t, err)
+	again, err := query.Bind(db1)
+	ok(t, err)
+	assert(t, filter1 == again, "filter should be cached per DB")
+	filter2, err := query.Bind(db2)
+	ok(t, err)
+	assert(t, filter1 != filter2, "filters should differ per DB")
+
+	trail := ApplyFilter(t, filter2, db2)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "e", "field2": "2"}, 2)
+	AssertEvent(t, trail.NextEvent(), map[string]string{"field1": "a", "field2": "4"}, 4)
+	AssertNotEvent(t, trail.NextEvent())
+
+	data, err := json.Marshal(query)
+	ok(t, err)
+	var decoded tdb.Query
+	ok(t, json.Unmarshal(data, &decoded))
+	equals(t, query.Clauses(), decoded.Clauses())
+
+	query.Close()
+	_, err = query.Bind(db1)
+	assert(t, err != nil, "should fail on closed query")
+
+	unknown := tdb.NewQuery([][]tdb.FilterTerm{{{Field: "field3", Value: "a"}}})
+	_, err = unknown.Bind(db1)
+	assert(t, err != nil, "should fail on unknown field")
+}
+
+func TestFindTrailIDs(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	for query, expected := range map[string][]uint64{
+		"field1=a":                {0, 1},
+		"field1=b OR field1=f":    {0, 1},
+		"field1=b":                {1},
+		"field1=a AND field2=4":   {0},
+		"field1=a AND NOT time<2": {0},
+		"field1=z":                nil,
+	} {
+		filter, err := db.ParseFilter(query)
+		ok(t, err)
+		for _, workers := range []int{0, 1, 4} {
+			ids, err := db.FindTrailIDs(filter, workers)
+			ok(t, err)
+			equals(t, expected, ids)
+		}
+		tdb.FreeEventFilter(filter)
+	}
+
+	_, err := db.FindTrails(map[string]string{"field3": "a"})
+	assert(t, err != nil, "should fail on unknown field")
+	trails, err := db.FindTrails(map[string]string{"field1": "a", "field2": "1"})
+	ok(t, err)
+	equals(t, 1, len(trails))
+	AssertEvent(t, trails[0].NextEvent(), map[string]string{"field1": "a", "field2": "1"}, 1)
+	trails[0].Close()
+
+	// no filters match every trail
+	ids, err := db.FindTrailIDs(nil, 0)
+	ok(t, err)
+	equals(t, []uint64{0, 1}, ids)
+	trails, err = db.FindTrails(map[string]string{})
+	ok(t, err)
+	equals(t, 2, len(trails))
+	for _, trail := range trails {
+		trail.Close()
+	}
+}
+
+func TestParallelScan(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	for _, workers := range []int{0, 1, 2, 8} {
+		scanWorkers, err := db.ParallelScan(context.Background(), workers,
+			func(w *tdb.Worker, trailID uint64, trail *tdb.Trail) error {
+				count, _ := w.State.(map[uint64]int)
+				if count == nil {
+					count = make(map[uint64]int)
+					w.State = count
+				}
+				for range trail.Events() {
+					count[trailID]++
+				}
+				return nil
+			})
+		ok(t, err)
+		counts := tdb.Reduce(scanWorkers, func(acc, count map[uint64]int) map[uint64]int {
+			for id, n := range count {
+				acc[id] += n
+			}
+			return acc
+		})
+		equals(t, map[uint64]int{0: 4, 1: 3}, counts)
+	}
+
+	filter, err := db.ParseFilter("field1=a")
+	ok(t, err)
+	scanWorkers, err := db.ParallelScan(context.Background(), 2,
+		func(w *tdb.Worker, trailID uint64, trail *tdb.Trail) error {
+			for range trail.Events() {
+				w.State = w.State.(int) + 1
+			}
+			return nil
+		},
+		tdb.WithScanFilter(filter),
+		tdb.WithWorkerInit(func(w *tdb.Worker) error {
+			w.State = 0
+			return nil
+		}))
+	ok(t, err)
+	equals(t, 2, tdb.Reduce(scanWorkers, func(acc, n int) int { return acc + n }))
+
+	failure := errors.New("failure")
+	_, err = db.ParallelScan(context.Background(), 2,
+		func(w *tdb.Worker, trailID uint64, trail *tdb.Trail) error {
+			return failure
+		})
+	equals(t, failure, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.ParallelScan(ctx, 2,
+		func(w *tdb.Worker, trailID uint64, trail *tdb.Trail) error {
+			return nil
+		})
+	equals(t, context.Canceled, err)
+}
+
+func TestScanContext(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	var reports []tdb.Progress
+	scanWorkers, err := db.ParallelScan(context.Background(), 1,
+		func(w *tdb.Worker, trailID uint64, trail *tdb.Trail) error {
+			for range trail.Events() {
+			}
+			return nil
+		},
+		tdb.WithProgress(func(p tdb.Progress) {
+			reports = append(reports, p)
+		}))
+	ok(t, err)
+	equals(t, 1, len(scanWorkers))
+	assert(t, len(reports) > 0, "no progress reported")
+	for i := 1; i < len(reports); i++ {
+		assert(t, reports[i].Trails >= reports[i-1].Trails, "trails decreased")
+		assert(t, reports[i].Events >= reports[i-1].Events, "events decreased")
+	}
+	equals(t, tdb.Progress{Trails: 2, Events: 7, TotalTrails: 2, TotalEvents: 7}, reports[len(reports)-1])
+
+	filter, err := db.ParseFilter("field1=a")
+	ok(t, err)
+	var last tdb.Progress
+	ids, err := db.FindTrailIDsContext(context.Background(), filter, 2,
+		tdb.WithProgress(func(p tdb.Progress) { last = p }))
+	ok(t, err)
+	equals(t, []uint64{0, 1}, ids)
+	equals(t, uint64(2), last.Trails)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.FindTrailIDsContext(ctx, filter, 2)
+	equals(t, context.Canceled, err)
+
+	// cancelling in the middle of a trail stops its cursor
+	defer func(interval uint64) { tdb.CONTEXT_CHECK_INTERVAL = interval }(tdb.CONTEXT_CHECK_INTERVAL)
+	tdb.CONTEXT_CHECK_INTERVAL = 0
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events := 0
+	for _, trail := range db.TrailsContext(ctx) {
+		for range trail.Events() {
+			events++
+			cancel()
+		}
+	}
+	equals(t, 1, events)
+	equals(t, context.Canceled, ctx.Err())
+
+	events = 0
+	trails := db.NewTrailIterator(ctx)
+	for range trails.All() {
+		events++
+	}
+	equals(t, 0, events)
+	equals(t, context.Canceled, trails.Err())
+
+	trail, err := tdb.NewTrail(db, 0)
+	ok(t, err)
+	defer trail.Close()
+	events = 0
+	for range trail.EventsContext(context.Background()) {
+		events++
+	}
+	equals(t, 4, events)
+	equals(t, uint64(4), trail.NumEventsRead())
+}
+
+func TestAggregate(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	result, err := db.Aggregate(tdb.AggregateSpec{
+		GroupBy: []string{"field2"},
+		Metrics: []tdb.Metric{tdb.Count, tdb.DistinctTrails, tdb.Sum("field2")},
+	})
+	ok(t, err)
+	equals(t, []string{"field2", "count", "distinct_trails", "sum(field2)"}, result.Columns)
+	equals(t, []tdb.AggregateRow{
+		{Group: []string{"1"}, Values: []float64{2, 2, 2}},
+		{Group: []string{"2"}, Values: []float64{2, 2, 4}},
+		{Group: []string{"3"}, Values: []float64{2, 2, 6}},
+		{Group: []string{"4"}, Values: []float64{1, 1, 4}},
+	}, result.Rows)
+
+	query, err := tdb.ParseQuery("field1!=a")
+	ok(t, err)
+	defer query.Close()
+	for _, workers := range []int{1, 2} {
+		result, err = db.Aggregate(tdb.AggregateSpec{
+			GroupBy: []string{"field2", "field1"},
+			Filter:  query,
+			Metrics: []tdb.Metric{tdb.Count},
+			Workers: workers,
+		})
+		ok(t, err)
+		equals(t, []tdb.AggregateRow{
+			{Group: []string{"1", "d"}, Values: []float64{1}},
+			{Group: []string{"2", "b"}, Values: []float64{1}},
+			{Group: []string{"2", "e"}, Values: []float64{1}},
+			{Group: []string{"3", "c"}, Values: []float64{1}},
+			{Group: []string{"3", "f"}, Values: []float64{1}},
+		}, result.Rows)
+	}
+
+	result, err = db.Aggregate(tdb.AggregateSpec{
+		Metrics: []tdb.Metric{tdb.Count, tdb.DistinctTrails},
+	})
+	ok(t, err)
+	equals(t, []tdb.AggregateRow{{Group: []string{}, Values: []float64{7, 2}}}, result.Rows)
+
+	_, err = db.Aggregate(tdb.AggregateSpec{GroupBy: []string{"nope"}})
+	var unknown *tdb.UnknownFieldError
+	assert(t, errors.As(err, &unknown), "expected an UnknownFieldError, got %v", err)
+	_, err = db.Aggregate(tdb.AggregateSpec{Metrics: []tdb.Metric{tdb.Sum("field1")}})
+	assert(t, err != nil, "expected an error for a non-numeric sum")
+}
+
+func TestTimeSeries(t *testing.T) {
+	db := LoadDB(t)
+	defer DeleteDB(t)
+
+	result, err := db.TimeSeries(2*time.Second, nil)
+	ok(t, err)
+	equals(t, 3, len(result.Buckets))
+	for i, bucket := range result.Buckets {
+		equals(t, int64(2*i), bucket.Unix())
+	}
+	equals(t, []string{"count"}, result.Metrics)
+	equals(t, []tdb.TimeSeriesGroup{{Group: []string{}, Values: [][]float64{{2, 4, 1}}}}, result.Series)
+
+	query, err := tdb.ParseQuery("field2!=2")
+	ok(t, err)
+	defer query.Close()
+	result, err = db.TimeSeries(2*time.Second, query, "field1")
+	ok(t, err)
+	equals(t, 3, len(result.Buckets))
+	equals(t, []tdb.TimeSeriesGroup{
+		{Group: []string{"a"}, Values: [][]float64{{1, 0, 1}}},
+		{Group: []string{"c"}, Values: [][]float64{{0, 1, 0}}},
+		{Group: []string{"d"}, Values: [][]float64{{1, 0, 0}}},
+		{Group: []string{"f"}, Values: [][]float64{{0, 1, 0}}},
+	}, result.Series)
+
+	// daily buckets start at midnight in the given location
+	loc := time.FixedZone("UTC+1", 60*60)
+	result, err = db.TimeSeriesContext(context.Background(), tdb.TimeSeriesSpec{
+		AggregateSpec: tdb.AggregateSpec{Metrics: []tdb.Metric{tdb.Count, tdb.DistinctTrails}},
+		Bucket:        24 * time.Hour,
+		Location:      loc,
+	})
+	ok(t, err)
+	equals(t, 1, len(result.Buckets))
+	assert(t, result.Buckets[0].Equal(time.Date(1970, 1, 1, 0, 0, 0, 0, loc)), "wrong daily bucket %v", result.Buckets[0])
+	equals(t, loc, result.Buckets[0].Location())
+	equals(t, [][]float64{{7}, {2}}, result.Series[0].Values)
+
+	// weekly buckets start on Mondays
+	result, err = db.TimeSeries(7*24*time.Hour, nil)
+	ok(t, err)
+	equals(t, 1, len(result.Buckets))
+	equals(t, time.Monday, result.Buckets[0].Weekday())
+	equals(t, time.Date(1969, 12, 29, 0, 0, 0, 0, time.UTC), result.Buckets[0])
+
+	_, err = db.TimeSeries(time.Millisecond, nil)
+	assert(t, err != nil, "expected an error for a sub-second bucket")
+
+	defer func(max int) { tdb.MAX_TIME_SERIES_BUCKETS = max }(tdb.MAX_TIME_SERIES_BUCKETS)
+	tdb.MAX_TIME_SERIES_BUCKETS = 3
+	_, err = db.TimeSeries(time.Second, nil)
+	assert(t, err != nil, "expected an error for too many buckets")
+	result, err = db.TimeSeries(2*time.Second, nil)
+	ok(t, err)
+	equals(t, 3, len(result.Buckets))
+}
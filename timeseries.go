@@ -0,0 +1,163 @@
+package tdb
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+)
+
+/*
+MAX_TIME_SERIES_BUCKETS is the maximum number of buckets of a time
+series. Every series holds a value per bucket and metric, so a bucket
+too small for the time span of the DB fails with an error instead.
+*/
+var MAX_TIME_SERIES_BUCKETS = 100000
+
+// buckets are aligned on Monday 1970-01-05 00:00, in wall clock seconds
+const bucketOrigin = 4 * 24 * 60 * 60
+
+/*
+TimeSeriesSpec describes a time series: an aggregation (see
+AggregateSpec) whose groups are also split by time bucket. Metrics
+defaults to Count.
+
+Buckets are Bucket long, in the wall clock time of Location (UTC if nil),
+and aligned on Monday 1970-01-05 00:00 in that location: daily buckets
+start at midnight and weekly buckets on Mondays, even across daylight
+saving time changes, where a bucket spans an hour more or less.
+*/
+type TimeSeriesSpec struct {
+	AggregateSpec
+	Bucket   time.Duration
+	Location *time.Location
+}
+
+/*
+TimeSeriesResult holds the series computed by TimeSeries. Buckets holds
+the start time of every bucket, from the bucket of the first event of
+the DB to that of its last event, and Metrics the names of the metrics.
+*/
+type TimeSeriesResult struct {
+	Buckets []time.Time
+	Metrics []string
+	Series  []TimeSeriesGroup
+}
+
+/*
+TimeSeriesGroup is a series of a TimeSeriesResult: Group holds the
+values of the GroupBy fields, and Values[i][j] the value of metric i in
+bucket j, 0 if the group has no events in the bucket.
+*/
+type TimeSeriesGroup struct {
+	Group  []string
+	Values [][]float64
+}
+
+/*
+TimeSeries counts the events matching filter (all events if nil) per
+time bucket and per values of the groupBy fields, with buckets aligned
+in UTC; see TimeSeriesContext for the other options. Event timestamps
+are taken as Unix times in seconds.
+*/
+func (db *TrailDB) TimeSeries(bucket time.Duration, filter *Query, groupBy ...string) (*TimeSeriesResult, error) {
+	return db.TimeSeriesContext(context.Background(), TimeSeriesSpec{
+		AggregateSpec: AggregateSpec{GroupBy: groupBy, Filter: filter},
+		Bucket:        bucket,
+	})
+}
+
+/*
+TimeSeriesContext computes the time series described by spec. The scan
+stops when ctx is done and takes scan options such as WithProgress.
+Series are sorted by group values.
+*/
+func (db *TrailDB) TimeSeriesContext(ctx context.Context, spec TimeSeriesSpec, opts ...ScanOption) (*TimeSeriesResult, error) {
+	if spec.Bucket < time.Second || spec.Bucket%time.Second != 0 {
+		return nil, errors.New("Time bucket must be a positive number of seconds: " + spec.Bucket.String())
+	}
+	loc := spec.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	if len(spec.Metrics) == 0 {
+		spec.Metrics = []Metric{Count}
+	}
+	size := int64(spec.Bucket / time.Second)
+	bucketOf := func(timestamp uint64) int64 {
+		_, offset := time.Unix(int64(timestamp), 0).In(loc).Zone()
+		wall := int64(timestamp) + int64(offset) - bucketOrigin
+		bucket := wall / size
+		if wall%size < 0 {
+			bucket--
+		}
+		return bucket
+	}
+
+	checkBuckets := func(first, last int64) error {
+		if last-first >= int64(MAX_TIME_SERIES_BUCKETS) {
+			return errors.New("Time bucket " + spec.Bucket.String() + " is too small, the time series would have more than " +
+				strconv.Itoa(MAX_TIME_SERIES_BUCKETS) + " buckets")
+		}
+		return nil
+	}
+
+	result := &TimeSeriesResult{}
+	for _, m := range spec.Metrics {
+		result.Metrics = append(result.Metrics, m.String())
+	}
+	if db.NumEvents == 0 {
+		return result, nil
+	}
+	first := bucketOf(db.minTimestamp)
+	last := bucketOf(db.maxTimestamp)
+	if err := checkBuckets(first, last); err != nil {
+		return nil, err
+	}
+	groups, err := db.aggregate(ctx, spec.AggregateSpec, bucketOf, opts)
+	if err != nil {
+		return nil, err
+	}
+	// wall clocks go back when daylight saving time ends
+	for _, group := range groups {
+		first = min(first, group.bucket)
+		last = max(last, group.bucket)
+	}
+	if err := checkBuckets(first, last); err != nil {
+		return nil, err
+	}
+	for bucket := first; bucket <= last; bucket++ {
+		wall := time.Unix(bucketOrigin+bucket*size, 0).UTC()
+		result.Buckets = append(result.Buckets, time.Date(wall.Year(), wall.Month(), wall.Day(),
+			wall.Hour(), wall.Minute(), wall.Second(), 0, loc))
+	}
+
+	// groups are keyed by bucket and items, series by items only
+	series := make(map[string]*TimeSeriesGroup)
+	for key, group := range groups {
+		key = key[8:]
+		s, ok := series[key]
+		if !ok {
+			s = &TimeSeriesGroup{
+				Group:  db.groupValues(group.items),
+				Values: make([][]float64, len(spec.Metrics)),
+			}
+			for i := range s.Values {
+				s.Values[i] = make([]float64, len(result.Buckets))
+			}
+			series[key] = s
+		}
+		for i, v := range group.values {
+			s.Values[i][group.bucket-first] = v
+		}
+	}
+	result.Series = make([]TimeSeriesGroup, 0, len(series))
+	for _, s := range series {
+		result.Series = append(result.Series, *s)
+	}
+	slices.SortFunc(result.Series, func(a, b TimeSeriesGroup) int {
+		return slices.Compare(a.Group, b.Group)
+	})
+	return result, nil
+}
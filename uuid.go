@@ -0,0 +1,69 @@
+package tdb
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+/*
+UUID is the raw 16-byte identifier of a trail. Using it instead of the
+32-char hex strings accepted by Add, GetTrailID and GetUUID avoids a hex
+round trip on every call.
+*/
+type UUID [16]byte
+
+/*
+ParseUUID parses either the 32-char hex form used elsewhere in this
+package ("12345678123456781234567812345678") or the dashed RFC-4122 form
+("12345678-1234-5678-1234-567812345678").
+*/
+func ParseUUID(s string) (UUID, error) {
+	var uuid UUID
+	switch len(s) {
+	case 32:
+	case 36:
+		if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+			return uuid, errors.New("UUID in the wrong format, misplaced dashes: " + s)
+		}
+		s = s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	default:
+		return uuid, errors.New("UUID in the wrong format, needs to be 32 hex chars or 36 chars with dashes: " + s)
+	}
+	if _, err := hex.Decode(uuid[:], []byte(s)); err != nil {
+		return uuid, err
+	}
+	return uuid, nil
+}
+
+// String returns the 32-char hex form of the UUID.
+func (uuid UUID) String() string {
+	return hex.EncodeToString(uuid[:])
+}
+
+// Dashed returns the dashed RFC-4122 form of the UUID.
+func (uuid UUID) Dashed() string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], uuid[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], uuid[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], uuid[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], uuid[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], uuid[10:])
+	return string(buf[:])
+}
+
+func (uuid UUID) MarshalText() ([]byte, error) {
+	return []byte(uuid.String()), nil
+}
+
+func (uuid *UUID) UnmarshalText(text []byte) error {
+	parsed, err := ParseUUID(string(text))
+	if err != nil {
+		return err
+	}
+	*uuid = parsed
+	return nil
+}